@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,8 +13,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -43,20 +46,25 @@ var variantTypes = map[string]interface{}{
 
 var _syliusToken string
 
-var _prices map[string]interface{}
+var _syliusTokenExpires time.Time
 
-var _values map[string]interface{}
+var _prices map[string]priceRecord
 
-var _manufacturers map[string]interface{}
+var _values map[string]string
 
-var _variants map[string][]map[string]interface{}
+var _manufacturers map[string]string
+
+var _variants map[string][]nomenclatureItem
+
+var _syliusLimiter *rateLimiter
+
+var _odinCLimiter *rateLimiter
+
+var _verbose bool
 
 func logVerbose(value interface{}) {
-	argsWithoutProg := os.Args[1:]
-	if len(argsWithoutProg) > 0 {
-		if argsWithoutProg[0] == "-v" {
-			fmt.Println(value)
-		}
+	if _verbose {
+		fmt.Println(value)
 	}
 }
 
@@ -64,23 +72,49 @@ func syncPrices() {
 	url := "/odata/standard.odata/InformationRegister_%D0%A6%D0%B5%D0%BD%D1%8B%D0%9D%D0%BE%D0%BC%D0%B5%D0%BD%D0%BA%D0%BB%D0%B0%D1%82%D1%83%D1%80%D1%8B/?$format=json"
 
 	pricesR := odinCRequest("GET", url, nil)
-	for _, readersRaw := range pricesR["value"].([]interface{}) {
-		readers := readersRaw.(map[string]interface{})
-		for _, priceItemRaw := range readers["RecordSet"].([]interface{}) {
-			priceItem := priceItemRaw.(map[string]interface{})
-			productCode := priceItem["Номенклатура_Key"].(string)
-			if priceItem["ВидЦены_Key"].(string) == "a0965697-a587-11e6-8857-14dae924f847" {
-				if savedItemR, ok := _prices[productCode]; ok {
-					savedItem := savedItemR.(map[string]interface{})
-					currentDate, _ := time.Parse(time.RFC3339, priceItem["Period"].(string)+"Z")
-					savedDate, _ := time.Parse(time.RFC3339, savedItem["Period"].(string)+"Z")
-					if currentDate.After(savedDate) {
-						_prices[productCode] = priceItem
-					}
-				} else {
-					_prices[productCode] = priceItem
-				}
-			}
+	for _, readers := range odataValues(pricesR) {
+		recordSet := &odataDecoder{name: "ЦеныНоменклатуры", item: readers}
+		for _, priceItem := range recordSet.list("RecordSet") {
+			addPriceRecord(priceItem)
+		}
+		if recordSet.err != nil {
+			color.Yellow("Skipping prices: " + recordSet.err.Error())
+		}
+	}
+}
+
+// priceFilterBatch is how many Номенклатура keys go into one price request.
+const priceFilterBatch = 40
+
+// syncPricesOf loads the prices of the given Номенклатура items only,
+// reading the single records of the register instead of every record set.
+func syncPricesOf(refKeys []string) {
+	for start := 0; start < len(refKeys); start += priceFilterBatch {
+		end := start + priceFilterBatch
+		if end > len(refKeys) {
+			end = len(refKeys)
+		}
+		conditions := make([]string, 0)
+		for _, refKey := range refKeys[start:end] {
+			conditions = append(conditions, "Номенклатура_Key eq guid'"+refKey+"'")
+		}
+		pricesR := odinCRequest("GET", collectionURL(pricesCollection+"_RecordType")+"&$filter="+odataEscape(strings.Join(conditions, " or ")), nil)
+		for _, priceItem := range odataValues(pricesR) {
+			addPriceRecord(priceItem)
+		}
+	}
+}
+
+// addPriceRecord keeps the latest retail price of each item.
+func addPriceRecord(priceItem map[string]interface{}) {
+	record, err := decodePriceRecord(priceItem)
+	if err != nil {
+		color.Yellow("Skipping price: " + err.Error())
+		return
+	}
+	if record.priceType == "a0965697-a587-11e6-8857-14dae924f847" {
+		if saved, ok := _prices[record.productKey]; !ok || record.period.After(saved.period) {
+			_prices[record.productKey] = record
 		}
 	}
 }
@@ -89,29 +123,55 @@ func fetchValues() {
 	url := "/odata/standard.odata/Catalog_%D0%97%D0%BD%D0%B0%D1%87%D0%B5%D0%BD%D0%B8%D1%8F%D0%A1%D0%B2%D0%BE%D0%B9%D1%81%D1%82%D0%B2%D0%9E%D0%B1%D1%8A%D0%B5%D0%BA%D1%82%D0%BE%D0%B2/?$format=json"
 
 	valuesR := odinCRequest("GET", url, nil)
-	for _, valuesR := range valuesR["value"].([]interface{}) {
-		valueItemRaw := valuesR.(map[string]interface{})
-		valueItem := valueItemRaw
-		ref := valueItem["Ref_Key"].(string)
-		name := valueItem["Description"].(string)
-		_values[ref] = name
+	for _, valueItemRaw := range odataValues(valuesR) {
+		valueItem, err := decodeReferenceItem(valueItemRaw)
+		if err != nil {
+			color.Yellow("Skipping value: " + err.Error())
+			continue
+		}
+		_values[valueItem.refKey] = valueItem.description
 	}
 }
 func fetchManufacturers() {
 	url := "/odata/standard.odata/Catalog_%D0%9F%D1%80%D0%BE%D0%B8%D0%B7%D0%B2%D0%BE%D0%B4%D0%B8%D1%82%D0%B5%D0%BB%D0%B8/?$format=json"
 
 	valuesR := odinCRequest("GET", url, nil)
-	for _, valuesR := range valuesR["value"].([]interface{}) {
-		valueItemRaw := valuesR.(map[string]interface{})
-		valueItem := valueItemRaw
-		ref := valueItem["Ref_Key"].(string)
-		name := valueItem["Description"].(string)
-		_manufacturers[ref] = name
+	for _, valueItemRaw := range odataValues(valuesR) {
+		valueItem, err := decodeReferenceItem(valueItemRaw)
+		if err != nil {
+			color.Yellow("Skipping publisher: " + err.Error())
+			continue
+		}
+		_manufacturers[valueItem.refKey] = valueItem.description
 	}
 }
 
 var _importedAuthors map[string]bool
 
+// authorProperties are the additional properties holding up to three authors.
+var authorProperties = []string{
+	"39c57eb5-5016-11e7-89aa-3085a93bff67",
+	"1041e448-b526-11ea-8190-74d02b904d6f",
+	"1041e44a-b526-11ea-8190-74d02b904d6f",
+}
+
+// propertyKeys maps the other additional properties the sync reads to their
+// Свойство_Key; the attribute ones are named by their Sylius attribute code.
+var propertyKeys = map[string]string{
+	"category":       "52f8b02d-552e-11e9-907f-14dae924f847",
+	"isbn":           "39c57eb4-5016-11e7-89aa-3085a93bff67",
+	"sostavitel":     "d33bd5eb-38f1-11ea-8177-74d02b904d6f",
+	"redactor":       "d33bd5ed-38f1-11ea-8177-74d02b904d6f",
+	"perevodchik":    "d33bd5ef-38f1-11ea-8177-74d02b904d6f",
+	"pages":          "d33bd5f1-38f1-11ea-8177-74d02b904d6f",
+	"cover_type":     "d33bd5f3-38f1-11ea-8177-74d02b904d6f",
+	"size":           "d33bd5f5-38f1-11ea-8177-74d02b904d6f",
+	"weight":         "d33bd5f7-38f1-11ea-8177-74d02b904d6f",
+	"recommendation": "d33bd5f9-38f1-11ea-8177-74d02b904d6f",
+	"original_price": "d33bd5fd-38f1-11ea-8177-74d02b904d6f",
+	"hidden":         "b3ac0624-bc51-11ea-8190-74d02b904d6f",
+}
+
 func pruneAuthors() {
 	existingAuthors := syliusRequest("GET", "/api/v1/taxons/authors", nil, "application/json")
 	for _, authorItem := range existingAuthors["children"].([]interface{}) {
@@ -162,8 +222,7 @@ func pruneManufacturers() {
 }
 
 func getManufacturerTaxon(ref string) string {
-	if val, ok := _manufacturers[ref]; ok {
-		name := val.(string)
+	if name, ok := _manufacturers[ref]; ok {
 		code := slugify.Slugify(name)
 
 		if _importedManufacturers[ref] {
@@ -193,42 +252,197 @@ func getManufacturerTaxon(ref string) string {
 	panic("Invalid manufacturer ref")
 }
 
+// markTaxonsInUse records the author and publisher taxons of a product
+// without creating them, so that pruning keeps them.
+func markTaxonsInUse(product nomenclatureItem) {
+	if name, ok := _manufacturers[product.manufacturerKey]; ok {
+		_importedManufacturers[slugify.Slugify(name)] = true
+	}
+	for _, property := range product.properties {
+		if containsString(authorProperties, property.key) {
+			if name, ok := _values[property.value]; ok {
+				_importedAuthors[slugify.Slugify(name)] = true
+			}
+		}
+	}
+}
+
 var validCategories map[string]bool
 
-func syncCategories() {
-	url := "/odata/standard.odata/Catalog_%D0%97%D0%BD%D0%B0%D1%87%D0%B5%D0%BD%D0%B8%D1%8F%D0%A1%D0%B2%D0%BE%D0%B9%D1%81%D1%82%D0%B2%D0%9E%D0%B1%D1%8A%D0%B5%D0%BA%D1%82%D0%BE%D0%B2%D0%98%D0%B5%D1%80%D0%B0%D1%80%D1%85%D0%B8%D1%8F/?$format=json"
+// categoryTaxon is a 1C category as it should be in Sylius.
+type categoryTaxon struct {
+	code     string
+	parent   string
+	name     string
+	root     string
+	path     []string
+	position int
+}
+
+// fetchCategories reads the category tree from 1C and marks the categories
+// to mirror as valid, without changing Sylius. Parents come before their
+// children; siblings keep the order set by hand in 1C, its
+// РеквизитДопУпорядочивания. CATEGORY_ORDER_FIELD=Code orders by code where
+// the catalog has no ordering attribute.
+func fetchCategories() []categoryTaxon {
+	url := "/odata/standard.odata/Catalog_%D0%97%D0%BD%D0%B0%D1%87%D0%B5%D0%BD%D0%B8%D1%8F%D0%A1%D0%B2%D0%BE%D0%B9%D1%81%D1%82%D0%B2%D0%9E%D0%B1%D1%8A%D0%B5%D0%BA%D1%82%D0%BE%D0%B2%D0%98%D0%B5%D1%80%D0%B0%D1%80%D1%85%D0%B8%D1%8F/?$format=json&$orderby=" + odataEscape(envOrDefault("CATEGORY_ORDER_FIELD", "РеквизитДопУпорядочивания")+" asc")
 
 	catgoriesR := odinCRequest("GET", url, nil)
 	validCategories = make(map[string]bool)
-	for _, categoriesRaw := range catgoriesR["value"].([]interface{}) {
-		category := categoriesRaw.(map[string]interface{})
-		code := category["Ref_Key"].(string)
-		parentKey := category["Parent_Key"].(string)
-		name := category["Description"].(string)
-		if parentKey == "d33bd5fe-38f1-11ea-8177-74d02b904d6f" || name == "Мерч" {
-			base := "category/books/"
-			parent := "books"
-			if name == "Мерч" {
-				base = "category/"
-				parent = "category"
+	children := make(map[string][]referenceItem)
+	merch := make([]referenceItem, 0)
+	for _, categoryRaw := range odataValues(catgoriesR) {
+		category, err := decodeReferenceItem(categoryRaw)
+		if err != nil {
+			color.Yellow("Skipping category: " + err.Error())
+			continue
+		}
+		children[category.parentKey] = append(children[category.parentKey], category)
+		if category.description == "Мерч" {
+			merch = append(merch, category)
+		}
+	}
+
+	categories := make([]categoryTaxon, 0)
+	var mirror func(tree map[string][]referenceItem, items []referenceItem, parent string, root string, path []string)
+	mirror = func(tree map[string][]referenceItem, items []referenceItem, parent string, root string, path []string) {
+		for position, category := range items {
+			code := category.refKey
+			if validCategories[code] {
+				continue
 			}
-			body, _ := json.Marshal(map[string]interface{}{
-				"code":   code,
-				"parent": parent,
-				"translations": map[string]interface{}{
-					"ru_RU": map[string]string{
-						"name": name,
-						"slug": base + slugify.Slugify(name),
-					},
-				},
+			name := category.description
+			categoryPath := append(append([]string{}, path...), name)
+			categories = append(categories, categoryTaxon{
+				code:     code,
+				parent:   parent,
+				name:     name,
+				root:     root,
+				path:     categoryPath,
+				position: position,
 			})
-			resp := syliusPutRequest("/api/v1/taxons/", code, bytes.NewReader(body), "application/json")
-			if val, ok := resp["errors"]; ok {
-				color.Red("ERROR categories!")
-				spew.Dump(val)
-			}
 			validCategories[code] = true
+			mirror(tree, tree[code], code, root, categoryPath)
+		}
+	}
+	// Мерч goes directly under the category root wherever it is in 1C
+	mirror(children, merch, "category", "category", nil)
+	for _, root := range categoryRoots() {
+		mirror(children, children[root.key], root.taxon, root.taxon, nil)
+	}
+	if folderTaxon := envOrDefault("FOLDER_TAXONS", ""); folderTaxon != "" {
+		folders := fetchFolders()
+		mirror(folders, folders[emptyRefKey], folderTaxon, folderTaxon, nil)
+	}
+	return categories
+}
+
+// _folderParents maps the Номенклатура folders to their parent folder.
+var _folderParents = make(map[string]string)
+
+// fetchFolders reads the Номенклатура folders, grouped by parent and
+// ordered by code, as Номенклатура has no ordering attribute.
+func fetchFolders() map[string][]referenceItem {
+	foldersR := odinCRequest("GET", nomenclatureURL+"&$filter="+odataEscape("IsFolder eq true")+"&$orderby="+odataEscape("Code asc"), nil)
+	folders := make(map[string][]referenceItem)
+	for _, folderRaw := range odataValues(foldersR) {
+		folder, err := decodeReferenceItem(folderRaw)
+		if err != nil {
+			color.Yellow("Skipping folder: " + err.Error())
+			continue
+		}
+		folders[folder.parentKey] = append(folders[folder.parentKey], folder)
+		_folderParents[folder.refKey] = folder.parentKey
+	}
+	return folders
+}
+
+// folderTaxons returns the mirrored folder taxons of a product, from its
+// own folder up to the top-level one.
+func folderTaxons(product nomenclatureItem) []string {
+	taxons := make([]string, 0)
+	folder := product.parentKey
+	for validCategories[folder] && !containsString(taxons, folder) {
+		taxons = append(taxons, folder)
+		folder = _folderParents[folder]
+	}
+	return taxons
+}
+
+// categoryRoot maps a 1C category group whose subtree is mirrored to the
+// Sylius taxon the subtree goes under.
+type categoryRoot struct {
+	key   string
+	taxon string
+}
+
+// categoryRoots reads CATEGORY_ROOTS, a comma-separated list of
+// <1C group Ref_Key>=<Sylius taxon code>.
+func categoryRoots() []categoryRoot {
+	roots := make([]categoryRoot, 0)
+	for _, entry := range strings.Split(envOrDefault("CATEGORY_ROOTS", "d33bd5fe-38f1-11ea-8177-74d02b904d6f=books"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			panic("Invalid CATEGORY_ROOTS entry: " + entry)
+		}
+		roots = append(roots, categoryRoot{key: strings.TrimSpace(parts[0]), taxon: strings.TrimSpace(parts[1])})
+	}
+	return roots
+}
+
+func syncCategories() {
+	rootSlugs := make(map[string]string)
+	for _, category := range fetchCategories() {
+		if _, ok := rootSlugs[category.root]; !ok {
+			rootSlugs[category.root] = taxonSlug(category.root)
+		}
+		slugParts := []string{rootSlugs[category.root]}
+		for _, name := range category.path {
+			slugParts = append(slugParts, slugify.Slugify(name))
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"code":     category.code,
+			"parent":   category.parent,
+			"position": category.position,
+			"translations": map[string]interface{}{
+				"ru_RU": map[string]string{
+					"name": category.name,
+					"slug": strings.Join(slugParts, "/"),
+				},
+			},
+		})
+		var resp map[string]interface{}
+		movedFrom := ""
+		existing := syliusRequest("GET", "/api/v1/taxons/"+category.code, nil, "application/json")
+		if existing["code"] == 404.00 {
+			logVerbose("Creating category: " + category.code)
+			resp = syliusRequest("POST", "/api/v1/taxons/", bytes.NewReader(body), "application/json")
+		} else {
+			if parent := taxonParentCode(existing); parent != category.parent {
+				movedFrom = parent
+			}
+			resp = syliusRequest("PATCH", "/api/v1/taxons/"+category.code, bytes.NewReader(body), "application/json")
+		}
+		if val, ok := resp["errors"]; ok {
+			color.Red("ERROR categories!")
+			spew.Dump(val)
+			continue
+		}
+		parent := category.parent
+		if movedFrom != "" && !_dryRun {
+			// check the move took, rather than trusting the PATCH with it
+			parent = taxonParentCode(syliusRequest("GET", "/api/v1/taxons/"+category.code, nil, "application/json"))
+			if parent == category.parent {
+				color.Yellow("Moved category " + category.name + " from " + movedFrom + " to " + category.parent)
+			} else {
+				color.Red("Category " + category.name + " stayed under " + parent + ", move it to " + category.parent + " in Sylius")
+			}
 		}
+		_state.Categories[category.code] = parent
 	}
 }
 
@@ -265,26 +479,55 @@ func fetchSyliusToken() {
 	}
 
 	_syliusToken = decodedBody["access_token"].(string)
+	if expiresIn, ok := decodedBody["expires_in"].(float64); ok {
+		_syliusTokenExpires = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	} else {
+		_syliusTokenExpires = time.Time{}
+	}
 }
 
-func initApp() {
+// ensureSyliusToken refreshes the token if it expires within the next minute.
+func ensureSyliusToken() {
+	if _syliusToken == "" || (!_syliusTokenExpires.IsZero() && time.Now().Add(time.Minute).After(_syliusTokenExpires)) {
+		fetchSyliusToken()
+	}
+}
+
+func loadEnv() {
+	// the profile file comes first: godotenv never overrides a loaded value
+	if _profile != "" {
+		if err := godotenv.Load(".env." + _profile); err != nil {
+			log.Fatalf("Cannot load profile %s: %s", _profile, err)
+		}
+	}
+	if _configFile != "" {
+		if err := godotenv.Load(_configFile); err != nil {
+			log.Fatalf("Cannot load config %s: %s", _configFile, err)
+		}
+		return
+	}
 	// loads values from .env into the system
 	if err := godotenv.Load(); err != nil {
 		log.Print("No .env file found")
 	}
+}
 
-	_importedAuthors = make(map[string]bool)
-	_importedManufacturers = make(map[string]bool)
-	_values = make(map[string]interface{})
-	_manufacturers = make(map[string]interface{})
-	_prices = make(map[string]interface{})
-	_variants = make(map[string][]map[string]interface{})
+func initApp() {
+	initRuntime()
+	if err := applyPropertyKeys(); err != nil {
+		log.Fatalf("Cannot map the 1C properties: %s", err)
+	}
+}
 
-	fetchSyliusToken()
-	syncCategories()
-	fetchValues()
-	syncPrices()
-	fetchManufacturers()
+// initRuntime sets up the limiters, the 1C source and the state.
+func initRuntime() {
+	_values = make(map[string]string)
+	_manufacturers = make(map[string]string)
+	_syliusLimiter = rateLimiterFromEnv("Sylius", "SYLIUS")
+	_odinCLimiter = rateLimiterFromEnv("1C", "1C")
+	_source = openSource(_sourceSpec)
+	resetRunState()
+	loadState()
 }
 
 func syliusRequest(requestType string, url string, body io.Reader, contentType string) map[string]interface{} {
@@ -296,6 +539,12 @@ func syliusRequest(requestType string, url string, body io.Reader, contentType s
 	if errRequest != nil {
 		panic(errRequest)
 	}
+	if _dryRun && requestType != "GET" {
+		planChange(requestType, url, body)
+		return map[string]interface{}{}
+	}
+	_syliusLimiter.acquire()
+	defer _syliusLimiter.release()
 	resp, errResp := client.Do(req)
 	if errResp != nil {
 		panic(errResp)
@@ -332,6 +581,9 @@ func syliusPutRequest(url string, slug string, body io.Reader, contentType strin
 }
 
 func odinCRequest(requestType string, url string, body io.Reader) map[string]interface{} {
+	if _source != nil {
+		return _source.get(url)
+	}
 	host, _ := os.LookupEnv("1C_HOST")
 	req, errRequest := http.NewRequest(requestType, host+url, body)
 	req.Header.Set("Content-Type", "application/json")
@@ -342,6 +594,8 @@ func odinCRequest(requestType string, url string, body io.Reader) map[string]int
 	if errRequest != nil {
 		panic(errRequest)
 	}
+	_odinCLimiter.acquire()
+	defer _odinCLimiter.release()
 	resp, errResp := client.Do(req)
 	if errResp != nil {
 		panic(errResp)
@@ -359,156 +613,128 @@ func odinCRequest(requestType string, url string, body io.Reader) map[string]int
 	return decodedBody
 }
 
-func importProduct(sourceProduct map[string]interface{}) {
+func importProduct(sourceProduct nomenclatureItem) (imported bool) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Println(r)
+			imported = false
 		}
 	}()
-	slug := sourceProduct["Артикул"].(string)
+	slug := sourceProduct.article
 
 	logVerbose("=== Importing product: " + slug + "===")
+	for _, item := range append([]nomenclatureItem{sourceProduct}, _variants[slug]...) {
+		if item.err != nil {
+			color.Red("Invalid 1C data: " + item.err.Error())
+			return false
+		}
+	}
 
 	type productAttribute map[string]string
 
 	var productTaxons []string
 	var productAttributes []productAttribute
 	mainTaxon := ""
-	weight := ""
-	width := ""
-	height := ""
-	depth := ""
-	manufacturerKey := sourceProduct["Производитель_Key"].(string)
-	if len(manufacturerKey) > 0 && manufacturerKey != "00000000-0000-0000-0000-000000000000" {
-		productTaxons = append(productTaxons, getManufacturerTaxon(sourceProduct["Производитель_Key"].(string)))
-	}
-	dops := sourceProduct["ДополнительныеРеквизиты"].([]interface{})
-
-	for _, dopRaw := range dops {
-		dop := dopRaw.(map[string]interface{})
+	manufacturerKey := sourceProduct.manufacturerKey
+	if len(manufacturerKey) > 0 && manufacturerKey != emptyRefKey {
+		productTaxons = append(productTaxons, getManufacturerTaxon(manufacturerKey))
+	}
+
+	for _, dop := range sourceProduct.properties {
 		// Category
-		if dop["Свойство_Key"].(string) == "52f8b02d-552e-11e9-907f-14dae924f847" && validCategories[dop["Значение"].(string)] {
-			productTaxons = append(productTaxons, dop["Значение"].(string))
-			mainTaxon = dop["Значение"].(string)
-		}
-		// Author1
-		if dop["Свойство_Key"].(string) == "39c57eb5-5016-11e7-89aa-3085a93bff67" {
-			authorRefString := dop["Значение"].(string)
-			if val, ok := _values[authorRefString]; ok {
-				authorName := val.(string)
-				productTaxons = append(productTaxons, getAuthorTaxon(authorName))
-			} else {
-				fmt.Println("Invalid author value", authorRefString)
-			}
-		}
-		// Author2
-		if dop["Свойство_Key"].(string) == "1041e448-b526-11ea-8190-74d02b904d6f" {
-			authorRefString := dop["Значение"].(string)
-			if val, ok := _values[authorRefString]; ok {
-				authorName := val.(string)
-				productTaxons = append(productTaxons, getAuthorTaxon(authorName))
-			} else {
-				fmt.Println("Invalid author value", authorRefString)
-			}
+		if dop.key == propertyKeys["category"] && validCategories[dop.value] {
+			productTaxons = append(productTaxons, dop.value)
+			mainTaxon = dop.value
 		}
-		// Author3
-		if dop["Свойство_Key"].(string) == "1041e44a-b526-11ea-8190-74d02b904d6f" {
-			authorRefString := dop["Значение"].(string)
-			if val, ok := _values[authorRefString]; ok {
-				authorName := val.(string)
+		// Author1, Author2, Author3
+		if containsString(authorProperties, dop.key) {
+			authorRefString := dop.value
+			if authorName, ok := _values[authorRefString]; ok {
 				productTaxons = append(productTaxons, getAuthorTaxon(authorName))
 			} else {
 				fmt.Println("Invalid author value", authorRefString)
 			}
 		}
 		// ISBN
-		if dop["Свойство_Key"].(string) == "39c57eb4-5016-11e7-89aa-3085a93bff67" {
+		if dop.key == propertyKeys["isbn"] {
 			var attribute = map[string]string{
 				"attribute":  "isbn",
 				"localeCode": "ru_RU",
-				"value":      dop["Значение"].(string),
+				"value":      dop.text(),
 			}
 			productAttributes = append(productAttributes, attribute)
 		}
 		// Sostavitel
-		if dop["Свойство_Key"].(string) == "d33bd5eb-38f1-11ea-8177-74d02b904d6f" {
+		if dop.key == propertyKeys["sostavitel"] {
 			var attribute = map[string]string{
 				"attribute":  "sostavitel",
 				"localeCode": "ru_RU",
-				"value":      dop["Значение"].(string),
+				"value":      dop.text(),
 			}
 			productAttributes = append(productAttributes, attribute)
 		}
 		// Redactor
-		if dop["Свойство_Key"].(string) == "d33bd5ed-38f1-11ea-8177-74d02b904d6f" {
+		if dop.key == propertyKeys["redactor"] {
 			var attribute = map[string]string{
 				"attribute":  "redactor",
 				"localeCode": "ru_RU",
-				"value":      dop["Значение"].(string),
+				"value":      dop.text(),
 			}
 			productAttributes = append(productAttributes, attribute)
 		}
 		// Perevodchik
-		if dop["Свойство_Key"].(string) == "d33bd5ef-38f1-11ea-8177-74d02b904d6f" {
+		if dop.key == propertyKeys["perevodchik"] {
 			var attribute = map[string]string{
 				"attribute":  "perevodchik",
 				"localeCode": "ru_RU",
-				"value":      dop["Значение"].(string),
+				"value":      dop.text(),
 			}
 			productAttributes = append(productAttributes, attribute)
 		}
-		if dop["Свойство_Key"].(string) == "d33bd5f1-38f1-11ea-8177-74d02b904d6f" {
+		if dop.key == propertyKeys["pages"] {
 			var attribute = map[string]string{
 				"attribute":  "pages",
 				"localeCode": "ru_RU",
-				"value":      dop["Значение"].(string),
+				"value":      dop.text(),
 			}
 			productAttributes = append(productAttributes, attribute)
 		}
-		if dop["Свойство_Key"].(string) == "d33bd5f3-38f1-11ea-8177-74d02b904d6f" {
+		if dop.key == propertyKeys["cover_type"] {
 			var attribute = map[string]string{
 				"attribute":  "cover_type",
 				"localeCode": "ru_RU",
-				"value":      dop["Значение"].(string),
+				"value":      dop.text(),
 			}
 			productAttributes = append(productAttributes, attribute)
 		}
-		if dop["Свойство_Key"].(string) == "d33bd5f9-38f1-11ea-8177-74d02b904d6f" {
+		if dop.key == propertyKeys["recommendation"] {
 			var attribute = map[string]string{
 				"attribute":  "recommendation",
 				"localeCode": "ru_RU",
-				"value":      dop["Значение"].(string),
+				"value":      dop.text(),
 			}
 			productAttributes = append(productAttributes, attribute)
 		}
-		if dop["Свойство_Key"].(string) == "d33bd5f5-38f1-11ea-8177-74d02b904d6f" {
-			dimensionsString := dop["Значение"].(string)
-			dimensions := strings.Split(dimensionsString, "х")
-			if len(dimensions) == 3 {
-				width = dimensions[0]
-				height = dimensions[1]
-				depth = dimensions[2]
-			}
-		}
-		if dop["Свойство_Key"].(string) == "d33bd5f7-38f1-11ea-8177-74d02b904d6f" {
-			weight = dop["Значение"].(string)
-		}
 		// set the discount if originalPrice is set
-		if dop["Свойство_Key"].(string) == "d33bd5fd-38f1-11ea-8177-74d02b904d6f" {
-			originalPrice, _ := strconv.ParseFloat(dop["Значение"].(string), 64)
+		if dop.key == propertyKeys["original_price"] {
+			originalPrice, _ := strconv.ParseFloat(dop.value, 64)
 			if originalPrice > 0 {
 				productTaxons = append(productTaxons, "6ad73508-09dc-11ea-98c8-08606ed6b998")
 			}
 		}
 	}
 
-	publishDate := sourceProduct["ДатаПереиздания"].(string)
-	if publishDate == "0001-01-01T00:00:00" {
-		publishDate = "1971-01-01T00:00:00"
+	// the property-based category stays the main taxon
+	for _, folder := range folderTaxons(sourceProduct) {
+		productTaxons = append(productTaxons, folder)
+		if mainTaxon == "" {
+			mainTaxon = folder
+		}
 	}
-	publishDateObject, err := time.Parse(time.RFC3339, publishDate+"Z")
-	if err != nil {
-		fmt.Println("Error while parsing date :", err)
+
+	publishDateObject := sourceProduct.publishDate
+	if publishDateObject.IsZero() {
+		publishDateObject = time.Date(1971, 1, 1, 0, 0, 0, 0, time.UTC)
 	}
 	var datePublish = map[string]string{
 		"attribute":  "publish_date",
@@ -522,9 +748,9 @@ func importProduct(sourceProduct map[string]interface{}) {
 		"enabled": true,
 		"translations": map[string]interface{}{
 			"ru_RU": map[string]string{
-				"name":             sourceProduct["НаименованиеЗаголовок"].(string),
-				"shortDescription": sourceProduct["НаименованиеПодаголовок"].(string),
-				"description":      sourceProduct["Описание_Сайт"].(string),
+				"name":             sourceProduct.title,
+				"shortDescription": sourceProduct.subtitle,
+				"description":      sourceProduct.siteDescription,
 				"slug":             slug,
 			},
 		},
@@ -534,7 +760,7 @@ func importProduct(sourceProduct map[string]interface{}) {
 
 	if additionalVariants, ok := _variants[slug]; ok {
 		for _, variant := range additionalVariants {
-			variantSlug := variant["Артикул"].(string)
+			variantSlug := variant.article
 			if variantSlug == slug+"_ebook" {
 				productTaxons = append(productTaxons, "ebooks")
 			}
@@ -562,148 +788,128 @@ func importProduct(sourceProduct map[string]interface{}) {
 		color.Red("ERROR product!")
 		fmt.Println(string(productBody))
 		spew.Dump(val)
-	} else {
-		variants := make([]map[string]interface{}, 0)
-		variants = append(variants, sourceProduct)
-		if additionalVariants, ok := _variants[slug]; ok {
-			variants = append(variants, additionalVariants...)
-		}
-
-		for _, variant := range variants {
-			variantSlug := variant["Артикул"].(string)
-			variantID := variant["Ref_Key"].(string)
-			splitVariantSlug := strings.Split(variantSlug, "_")
-			var variantType string
-			if len(splitVariantSlug) == 1 {
-				variantType = "default"
-			} else if len(splitVariantSlug) == 2 {
-				variantType = splitVariantSlug[1]
-			} else {
-				panic("Too many underscores in the variant: " + variantSlug)
-			}
-			if _, ok := variantTypes[variantType]; !ok {
-				panic("Wrong variant: " + variantSlug)
+		return false
+	}
+	importVariants(slug, sourceProduct, parseDimensions(sourceProduct))
+	return true
+}
+
+// parseDimensions reads the weight and the "ШxВxГ" size of a product into
+// the Sylius variant fields, leaving out what is not filled in 1C.
+func parseDimensions(sourceProduct nomenclatureItem) map[string]string {
+	dimensions := make(map[string]string)
+	for _, dop := range sourceProduct.properties {
+		if dop.key == propertyKeys["size"] {
+			dimensionsString := dop.text()
+			size := strings.Split(dimensionsString, "х")
+			if len(size) == 3 {
+				dimensions["width"] = size[0]
+				dimensions["height"] = size[1]
+				dimensions["depth"] = size[2]
 			}
+		}
+		if dop.key == propertyKeys["weight"] {
+			dimensions["weight"] = dop.text()
+		}
+	}
+	for key, value := range dimensions {
+		if value == "" {
+			delete(dimensions, key)
+		}
+	}
+	return dimensions
+}
 
-			var originalPrice float64
-			hidden := false
-			dops := variant["ДополнительныеРеквизиты"].([]interface{})
+// originalPriceOf returns the price before discount of a variant, 0 if it
+// is not discounted.
+func originalPriceOf(variant nomenclatureItem) float64 {
+	originalPrice, _ := strconv.ParseFloat(variant.property(propertyKeys["original_price"]), 64)
+	return originalPrice
+}
 
-			for _, dopRaw := range dops {
-				dop := dopRaw.(map[string]interface{})
-				if dop["Свойство_Key"].(string) == "d33bd5fd-38f1-11ea-8177-74d02b904d6f" {
-					originalPrice, _ = strconv.ParseFloat(dop["Значение"].(string), 64)
-				}
-				if dop["Свойство_Key"].(string) == "b3ac0624-bc51-11ea-8190-74d02b904d6f" {
-					hiddenValue, _ := dop["Значение"].(string)
-					if hiddenValue == "true" {
-						hidden = true
-					}
-				}
-			}
+// importVariants creates or updates the variants of a product: the product
+// item itself and its `_`-suffixed articles. Variants without a price are
+// deleted; variants without a 1C article are collected for pruning.
+func importVariants(slug string, sourceProduct nomenclatureItem, dimensions map[string]string) {
+	variants := make([]nomenclatureItem, 0)
+	variants = append(variants, sourceProduct)
+	if additionalVariants, ok := _variants[slug]; ok {
+		variants = append(variants, additionalVariants...)
+	}
+	collectStaleVariants(slug, variants)
+
+	for _, variant := range variants {
+		variantSlug := variant.article
+		variantID := variant.refKey
+		splitVariantSlug := strings.Split(variantSlug, "_")
+		var variantType string
+		if len(splitVariantSlug) == 1 {
+			variantType = "default"
+		} else if len(splitVariantSlug) == 2 {
+			variantType = splitVariantSlug[1]
+		} else {
+			panic("Too many underscores in the variant: " + variantSlug)
+		}
+		if _, ok := variantTypes[variantType]; !ok {
+			panic("Wrong variant: " + variantSlug)
+		}
+
+		originalPrice := originalPriceOf(variant)
+		hidden := variant.property(propertyKeys["hidden"]) == "true"
 
-			if priceItem, ok := _prices[variantID]; ok && priceItem.(map[string]interface{})["Цена"].(float64) > 0.00 {
-				variantObject := map[string]interface{}{
-					"code":             variantSlug,
-					"tracked":          false,
-					"shippingRequired": variantTypes[variantType].(map[string]interface{})["shippingRequired"].(bool),
-					"translations": map[string]interface{}{
-						"ru_RU": map[string]string{
-							"name": variantTypes[variantType].(map[string]interface{})["title"].(string),
-						},
+		if priceItem, ok := _prices[variantID]; ok && priceItem.price > 0.00 {
+			variantObject := map[string]interface{}{
+				"code":             variantSlug,
+				"tracked":          false,
+				"shippingRequired": variantTypes[variantType].(map[string]interface{})["shippingRequired"].(bool),
+				"translations": map[string]interface{}{
+					"ru_RU": map[string]string{
+						"name": variantTypes[variantType].(map[string]interface{})["title"].(string),
 					},
-					"channelPricings": map[string]interface{}{
-						"default": map[string]float64{
-							"price": priceItem.(map[string]interface{})["Цена"].(float64),
-						},
+				},
+				"channelPricings": map[string]interface{}{
+					"default": map[string]interface{}{
+						"price":         priceItem.price,
+						"originalPrice": nil,
 					},
+				},
+			}
+			if hidden {
+				variantObject["tracked"] = true
+				variantObject["onHand"] = 0
+			}
+			if variantType == "default" {
+				for key, value := range dimensions {
+					variantObject[key] = value
 				}
-				if hidden {
-					variantObject["tracked"] = true
-					variantObject["onHand"] = 0
-				}
-				if variantType == "default" {
-					if weight != "" {
-						variantObject["weight"] = weight
-					}
-					if width != "" {
-						variantObject["width"] = width
-					}
-					if height != "" {
-						variantObject["height"] = height
-					}
-					if depth != "" {
-						variantObject["depth"] = depth
-					}
-				}
-				if originalPrice > 0 {
-					variantObject["channelPricings"].(map[string]interface{})["default"].(map[string]float64)["originalPrice"] = originalPrice
-				}
-				variantBody, _ := json.Marshal(variantObject)
-				variantsResult := syliusPutRequest("/api/v1/products/"+slug+"/variants/", variantSlug, bytes.NewReader(variantBody), "application/json")
-				if val, ok := variantsResult["errors"]; ok {
-					color.Red("ERROR variants!")
-					fmt.Println(val)
-				}
+			}
+			if originalPrice > 0 {
+				variantObject["channelPricings"].(map[string]interface{})["default"].(map[string]interface{})["originalPrice"] = originalPrice
+			}
+			variantBody, _ := json.Marshal(variantObject)
+			variantsResult := syliusPutRequest("/api/v1/products/"+slug+"/variants/", variantSlug, bytes.NewReader(variantBody), "application/json")
+			if val, ok := variantsResult["errors"]; ok {
+				color.Red("ERROR variants!")
+				fmt.Println(val)
 			} else {
-				syliusRequest("DELETE", "/api/v1/products/"+slug+"/variants/"+variantSlug, nil, "application/json")
-				color.Yellow("Price not available, deleted variant")
+				_state.Prices[variantSlug] = variantPrice{Price: priceItem.price, OriginalPrice: originalPrice}
 			}
-
+		} else {
+			syliusRequest("DELETE", "/api/v1/products/"+slug+"/variants/"+variantSlug, nil, "application/json")
+			delete(_state.Prices, variantSlug)
+			color.Yellow("Price not available, deleted variant")
 		}
+
 	}
 }
 
 func main() {
-	fmt.Println("Syncing 1C and Sylius")
-	initApp()
-
-	_existingProducts := make([]string, 0)
-	existingProducts := syliusRequest("GET", "/api/v1/products/?limit=1000", nil, "application/json")
-	for _, product := range existingProducts["_embedded"].(map[string]interface{})["items"].([]interface{}) {
-		_existingProducts = append(_existingProducts, product.(map[string]interface{})["code"].(string))
-	}
-
-	logVerbose("Get products from 1C")
-	_newProducts := make([]string, 0)
-	products := make([]interface{}, 0)
-	productsAndVariantsRaw := odinCRequest("GET", "/odata/standard.odata/Catalog_%D0%9D%D0%BE%D0%BC%D0%B5%D0%BD%D0%BA%D0%BB%D0%B0%D1%82%D1%83%D1%80%D0%B0/?$format=json&$filter=%D0%90%D1%80%D1%82%D0%B8%D0%BA%D1%83%D0%BB%20ne%20%27%27&$orderby=%D0%94%D0%B0%D1%82%D0%B0%D0%9F%D0%B5%D1%80%D0%B5%D0%B8%D0%B7%D0%B4%D0%B0%D0%BD%D0%B8%D1%8F%20asc", nil)
-	// productsAndVariantsRaw := odinCRequest("GET", "/odata/standard.odata/Catalog_%D0%9D%D0%BE%D0%BC%D0%B5%D0%BD%D0%BA%D0%BB%D0%B0%D1%82%D1%83%D1%80%D0%B0/?$format=json&$filter=%D0%90%D1%80%D1%82%D0%B8%D0%BA%D1%83%D0%BB%20eq%20%27ethics-10%27", nil)
-	productsAndVariants := productsAndVariantsRaw["value"].([]interface{})
-	for _, productRaw := range productsAndVariants {
-		sourceProduct := productRaw.(map[string]interface{})
-		slug := sourceProduct["Артикул"].(string)
-		subparts := strings.Split(slug, "_")
-		if len(subparts) == 2 {
-			productSlug := subparts[0]
-			if _, ok := _variants[productSlug]; !ok {
-				_variants[productSlug] = make([]map[string]interface{}, 0)
-			}
-			_variants[productSlug] = append(_variants[productSlug], sourceProduct)
-		} else {
-			products = append(products, sourceProduct)
-		}
-	}
-	for _, productRaw := range products {
-		sourceProduct := productRaw.(map[string]interface{})
-		slug := sourceProduct["Артикул"].(string)
-		importProduct(sourceProduct)
-		_newProducts = append(_newProducts, slug)
-	}
-
-	for _, slug := range _existingProducts {
-		if !containsString(_newProducts, slug) {
-			body, _ := json.Marshal(map[string]interface{}{
-				"enabled": false,
-			})
-			syliusRequest("PATCH", "/api/v1/products/"+slug, bytes.NewReader(body), "application/json")
-			logVerbose("Disabled " + slug)
-		}
-	}
+	// finish the in-flight product on SIGINT/SIGTERM instead of dying mid-way
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	defer releaseRunLock()
 
-	pruneAuthors()
-	pruneManufacturers()
-	fmt.Println("Done!")
+	runCommand(ctx, os.Args[1:])
 }
 
 func makeMultipartBody(values map[string]interface{}) (body io.Reader, contentType string) {
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// catalogVariant is a variant of a catalog product; price is 0 when 1C
+// has no price for it.
+type catalogVariant struct {
+	article       string
+	variantType   string
+	price         float64
+	originalPrice float64
+	hidden        bool
+}
+
+// catalogProduct is a 1C product with everything the exports need,
+// assembled from the same properties importProduct reads.
+type catalogProduct struct {
+	article        string
+	name           string
+	subtitle       string
+	description    string
+	publisher      string
+	authors        []string
+	compilers      []string
+	editors        []string
+	translators    []string
+	isbn           string
+	pages          string
+	coverType      string
+	recommendation string
+	// size is the "ШхВхГ" value as entered in 1C, dimensions its parsed
+	// form together with the weight
+	size        string
+	dimensions  map[string]string
+	category    string
+	publishDate time.Time
+	variants    []catalogVariant
+}
+
+// productURL is the storefront page of a product, built from SHOP_URL and
+// the Sylius slug, which is the article.
+func productURL(slug string) string {
+	shopURL, _ := os.LookupEnv("SHOP_URL")
+	return strings.TrimRight(shopURL, "/") + "/ru_RU/products/" + slug
+}
+
+// variantTypeOf returns the variantTypes key of a variant article.
+func variantTypeOf(article string) string {
+	parts := strings.Split(article, "_")
+	if len(parts) == 2 {
+		return parts[1]
+	}
+	return "default"
+}
+
+func collectCatalogProduct(sourceProduct nomenclatureItem) catalogProduct {
+	product := catalogProduct{
+		article:     sourceProduct.article,
+		name:        sourceProduct.title,
+		subtitle:    sourceProduct.subtitle,
+		description: sourceProduct.siteDescription,
+		dimensions:  parseDimensions(sourceProduct),
+		publishDate: sourceProduct.publishDate,
+	}
+	if publisher, ok := _manufacturers[sourceProduct.manufacturerKey]; ok {
+		product.publisher = publisher
+	}
+	for _, dop := range sourceProduct.properties {
+		key := dop.key
+		value := dop.value
+		switch {
+		case containsString(authorProperties, key):
+			if author, ok := _values[value]; ok {
+				product.authors = append(product.authors, author)
+			}
+		case key == propertyKeys["category"] && validCategories[value]:
+			product.category = value
+		case key == propertyKeys["isbn"]:
+			product.isbn = dop.text()
+		case key == propertyKeys["sostavitel"]:
+			product.compilers = append(product.compilers, dop.text())
+		case key == propertyKeys["redactor"]:
+			product.editors = append(product.editors, dop.text())
+		case key == propertyKeys["perevodchik"]:
+			product.translators = append(product.translators, dop.text())
+		case key == propertyKeys["pages"]:
+			product.pages = dop.text()
+		case key == propertyKeys["cover_type"]:
+			product.coverType = dop.text()
+		case key == propertyKeys["size"]:
+			product.size = dop.text()
+		case key == propertyKeys["recommendation"]:
+			product.recommendation = dop.text()
+		}
+	}
+	if product.category == "" {
+		if folders := folderTaxons(sourceProduct); len(folders) > 0 {
+			product.category = folders[0]
+		}
+	}
+
+	for _, variant := range append([]nomenclatureItem{sourceProduct}, _variants[product.article]...) {
+		article := variant.article
+		if _, ok := variantTypes[variantTypeOf(article)]; !ok {
+			continue
+		}
+		catalogVariant := catalogVariant{
+			article:       article,
+			variantType:   variantTypeOf(article),
+			originalPrice: originalPriceOf(variant),
+			hidden:        variant.property(propertyKeys["hidden"]) == "true",
+		}
+		if priceItem, ok := _prices[variant.refKey]; ok {
+			catalogVariant.price = priceItem.price
+		}
+		product.variants = append(product.variants, catalogVariant)
+	}
+	return product
+}
+
+// collectCatalog reads everything the exports need from 1C without
+// touching Sylius.
+func collectCatalog() ([]catalogProduct, []categoryTaxon) {
+	categories := fetchCategories()
+	fetchValues()
+	fetchManufacturers()
+	syncPrices()
+	products := make([]catalogProduct, 0)
+	for _, sourceProduct := range fetchProducts("Артикул ne ''") {
+		if sourceProduct.err != nil {
+			color.Yellow("Skipping invalid 1C data: " + sourceProduct.err.Error())
+			continue
+		}
+		products = append(products, collectCatalogProduct(sourceProduct))
+	}
+	return products, categories
+}
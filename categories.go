@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// taxonParentCode returns the code of the parent of a taxon read from Sylius.
+func taxonParentCode(taxon map[string]interface{}) string {
+	switch parent := taxon["parent"].(type) {
+	case map[string]interface{}:
+		code, _ := parent["code"].(string)
+		return code
+	case string:
+		// an IRI or a plain code
+		return parent[strings.LastIndex(parent, "/")+1:]
+	}
+	return ""
+}
+
+// taxonSlug reads the ru_RU slug of a taxon, falling back to its code.
+func taxonSlug(code string) string {
+	taxon := syliusRequest("GET", "/api/v1/taxons/"+code, nil, "application/json")
+	if translations, ok := taxon["translations"].(map[string]interface{}); ok {
+		if translation, ok := translations["ru_RU"].(map[string]interface{}); ok {
+			if slug, ok := translation["slug"].(string); ok && slug != "" {
+				return slug
+			}
+		}
+	}
+	return code
+}
+
+// staleCategories lists the category taxons created from 1C, or found under
+// a root taxon with a 1C key for a code, that no longer qualify. Taxons
+// disabled by an earlier run are left out.
+func staleCategories() []string {
+	stale := make([]string, 0)
+	for code := range _state.Categories {
+		if !validCategories[code] {
+			stale = append(stale, code)
+		}
+	}
+	for _, root := range categoryRoots() {
+		rootTaxon := syliusRequest("GET", "/api/v1/taxons/"+root.taxon, nil, "application/json")
+		children, _ := rootTaxon["children"].([]interface{})
+		for _, child := range children {
+			code := child.(map[string]interface{})["code"].(string)
+			if enabled, ok := child.(map[string]interface{})["enabled"].(bool); ok && !enabled {
+				continue
+			}
+			if guidPattern.MatchString(code) && !validCategories[code] && !containsString(stale, code) {
+				stale = append(stale, code)
+			}
+		}
+	}
+	return stale
+}
+
+// pruneCategories deletes the category taxons whose 1C group no longer
+// qualifies, or with CATEGORY_PRUNE_MODE=disable disables them, within the
+// safety thresholds.
+func pruneCategories(report *runReport) {
+	stale := staleCategories()
+	if err := checkRemovalThreshold("categories", len(stale), len(_state.Categories)); err != nil {
+		reason := "category prune skipped: " + err.Error() + ", use --force to override"
+		trackProgress(func() {
+			if report.SafetyAbort != "" {
+				report.SafetyAbort += "; "
+			}
+			report.SafetyAbort += reason
+		})
+		return
+	}
+	disable := strings.ToLower(envOrDefault("CATEGORY_PRUNE_MODE", "delete")) == "disable"
+	for _, code := range stale {
+		if disable {
+			body, _ := json.Marshal(map[string]interface{}{
+				"enabled": false,
+			})
+			syliusRequest("PATCH", "/api/v1/taxons/"+code, bytes.NewReader(body), "application/json")
+			logVerbose("Disabled category " + code)
+		} else {
+			syliusRequest("DELETE", "/api/v1/taxons/"+code, nil, "application/json")
+			logVerbose("Deleted category " + code)
+		}
+		delete(_state.Categories, code)
+		trackProgress(func() { report.PrunedCategories++ })
+	}
+}
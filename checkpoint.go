@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// checkpoint records the progress of an interrupted products loop so that
+// the next run started with --resume can skip what is already imported.
+type checkpoint struct {
+	Products      []string `json:"products"`
+	Authors       []string `json:"authors"`
+	Manufacturers []string `json:"manufacturers"`
+}
+
+func checkpointPath() string {
+	if path, ok := os.LookupEnv("CHECKPOINT_FILE"); ok && path != "" {
+		return path
+	}
+	return "1csync.checkpoint.json"
+}
+
+func saveCheckpoint(products []string) {
+	state := checkpoint{
+		Products:      products,
+		Authors:       make([]string, 0),
+		Manufacturers: make([]string, 0),
+	}
+	for code := range _importedAuthors {
+		state.Authors = append(state.Authors, code)
+	}
+	for code := range _importedManufacturers {
+		state.Manufacturers = append(state.Manufacturers, code)
+	}
+	body, _ := json.Marshal(state)
+	if err := ioutil.WriteFile(checkpointPath(), body, 0644); err != nil {
+		panic(err)
+	}
+}
+
+// loadCheckpoint restores imported authors and manufacturers from the
+// checkpoint, so they are not pruned, and returns the processed SKUs.
+func loadCheckpoint() map[string]bool {
+	processed := make(map[string]bool)
+	body, err := ioutil.ReadFile(checkpointPath())
+	if os.IsNotExist(err) {
+		logVerbose("No checkpoint found, starting from the beginning")
+		return processed
+	}
+	if err != nil {
+		panic(err)
+	}
+	var state checkpoint
+	if errJSON := json.Unmarshal(body, &state); errJSON != nil {
+		panic(errJSON)
+	}
+	for _, slug := range state.Products {
+		processed[slug] = true
+	}
+	for _, code := range state.Authors {
+		_importedAuthors[code] = true
+	}
+	for _, code := range state.Manufacturers {
+		_importedManufacturers[code] = true
+	}
+	return processed
+}
+
+func removeCheckpoint() {
+	if err := os.Remove(checkpointPath()); err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+const exitCodeUsage = 2
+
+var _configFile string
+
+var _profile string
+
+var _outputFormat = outputText
+
+const usage = `Usage: 1csync [global flags] <command> [flags]
+
+Commands:
+  sync                 import all 1C products into Sylius (the default)
+  sync prices          update changed variant prices without touching product content
+  sync categories      sync category taxons only
+  prune                disable products missing in 1C, prune authors and publishers
+  plan                 list the Sylius changes a full sync would make
+  inspect properties   list the 1C additional properties and which ones are mapped
+  doctor               check the configuration and the connection to 1C and Sylius
+  export <format>      write the 1C catalog in the given format (json, yml, onix,
+                       merchant, merchant-tsv)
+  snapshot <dir>       save the 1C data the sync reads, for --source=snapshot:<dir>
+  serve                run scheduled syncs and the control API
+
+Global flags (also accepted after the command):
+`
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// registerGlobalFlags adds the global flags to a flag set, keeping the
+// values already parsed by the command line before the command.
+func registerGlobalFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&_verbose, "v", _verbose, "verbose output")
+	flags.StringVar(&_configFile, "config", _configFile, "env file to load instead of .env")
+	flags.StringVar(&_profile, "profile", _profile, "env profile, loads .env.<profile> over the config")
+	flags.StringVar(&_outputFormat, "output", _outputFormat, "output format: text or json")
+	flags.StringVar(&_sourceSpec, "source", _sourceSpec, "1C data source: odata, commerceml:<dir> or snapshot:<dir>")
+}
+
+func newCommandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	registerGlobalFlags(flags)
+	return flags
+}
+
+func parseCommandFlags(flags *flag.FlagSet, args []string) {
+	flags.Parse(args)
+	if _outputFormat != outputText && _outputFormat != outputJSON {
+		fmt.Println("Unknown output format: " + _outputFormat)
+		os.Exit(exitCodeUsage)
+	}
+}
+
+// readSKUFile reads one article per line, skipping blank lines and # comments.
+func readSKUFile(path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	skus := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		skus = append(skus, line)
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	return skus
+}
+
+// runCommand dispatches the command line to the commands.
+func runCommand(ctx context.Context, args []string) {
+	root := flag.NewFlagSet("1csync", flag.ExitOnError)
+	registerGlobalFlags(root)
+	root.Usage = func() {
+		fmt.Fprint(root.Output(), usage)
+		root.PrintDefaults()
+	}
+	parseCommandFlags(root, args)
+	command := root.Arg(0)
+	args = root.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+
+	switch command {
+	case "", "sync":
+		if len(args) > 0 && args[0] == "prices" {
+			syncPricesCommand(ctx, args[1:])
+		} else if len(args) > 0 && args[0] == "categories" {
+			syncCategoriesCommand(args[1:])
+		} else {
+			syncCommand(ctx, args)
+		}
+	case "prune":
+		pruneCommand(args)
+	case "plan":
+		planCommand(ctx, args)
+	case "inspect":
+		inspectCommand(args)
+	case "doctor":
+		doctorCommand(args)
+	case "export":
+		exportCommand(args)
+	case "snapshot":
+		snapshotCommand(args)
+	case "serve":
+		serveCommand(ctx, args)
+	default:
+		fmt.Println("Unknown command: " + command)
+		root.Usage()
+		os.Exit(exitCodeUsage)
+	}
+}
+
+// startCommand loads the configuration and, for commands writing to
+// Sylius, takes the run lock.
+func startCommand(lock bool) {
+	loadEnv()
+	if lock {
+		acquireRunLock()
+	}
+	initApp()
+}
+
+func finishCommand(report *runReport) {
+	printRunReport(report)
+	if !report.Interrupted && _outputFormat == outputText {
+		fmt.Println("Done!")
+	}
+}
+
+// syncCommand runs `1csync sync [--sku article]... [--sku-file path]`.
+// Without articles it is a full sync; with them only those articles and
+// their variants are imported and nothing is disabled or pruned.
+func syncCommand(ctx context.Context, args []string) {
+	flags := newCommandFlags("sync")
+	var skus stringList
+	flags.Var(&skus, "sku", "article to sync, can be repeated")
+	skuFile := flags.String("sku-file", "", "file with one article per line")
+	resume := flags.Bool("resume", false, "continue from the checkpoint of an interrupted run")
+	flags.BoolVar(&_force, "force", false, "disable and prune even beyond the safety thresholds")
+	parseCommandFlags(flags, args)
+
+	if *skuFile != "" {
+		skus = append(skus, readSKUFile(*skuFile)...)
+	}
+
+	startCommand(true)
+	if len(skus) > 0 {
+		if _outputFormat == outputText {
+			fmt.Println("Syncing 1C and Sylius:", skus.String())
+		}
+		refreshReferences()
+		finishCommand(syncSKUs(ctx, skus))
+		return
+	}
+	if _outputFormat == outputText {
+		fmt.Println("Syncing 1C and Sylius")
+	}
+	finishCommand(runSync(ctx, syncOptions{mode: syncModeFull, resume: *resume}))
+}
+
+func syncPricesCommand(ctx context.Context, args []string) {
+	parseCommandFlags(newCommandFlags("sync prices"), args)
+	startCommand(true)
+	finishCommand(runPriceSync(ctx))
+}
+
+func syncCategoriesCommand(args []string) {
+	parseCommandFlags(newCommandFlags("sync categories"), args)
+	startCommand(true)
+	ensureSyliusToken()
+	syncCategories()
+	saveState()
+	if _outputFormat == outputText {
+		fmt.Println("Synced categories:", len(validCategories))
+	}
+}
+
+func pruneCommand(args []string) {
+	flags := newCommandFlags("prune")
+	flags.BoolVar(&_force, "force", false, "disable and prune even beyond the safety thresholds")
+	parseCommandFlags(flags, args)
+	startCommand(true)
+	finishCommand(runPrune())
+}
+
+// planCommand runs a full sync with all Sylius writes recorded instead
+// of sent.
+func planCommand(ctx context.Context, args []string) {
+	flags := newCommandFlags("plan")
+	flags.BoolVar(&_force, "force", false, "plan disabling and pruning even beyond the safety thresholds")
+	parseCommandFlags(flags, args)
+	startCommand(false)
+	_dryRun = true
+	report := runSync(ctx, syncOptions{mode: syncModeFull})
+	printPlan()
+	if _outputFormat == outputText {
+		printRunReport(report)
+	}
+}
+
+func doctorCommand(args []string) {
+	parseCommandFlags(newCommandFlags("doctor"), args)
+	loadEnv()
+	checks := runDoctor()
+	printDoctor(checks)
+	for _, check := range checks {
+		if !check.OK {
+			os.Exit(1)
+		}
+	}
+}
+
+// inspectCommand runs `1csync inspect properties [--items]`.
+func inspectCommand(args []string) {
+	flags := newCommandFlags("inspect")
+	countItems := flags.Bool("items", false, "count the Номенклатура items using each property, reading the whole catalog")
+	if len(args) == 0 || args[0] != "properties" {
+		fmt.Println("Usage: 1csync inspect properties [--items]")
+		os.Exit(exitCodeUsage)
+	}
+	parseCommandFlags(flags, args[1:])
+	loadEnv()
+	// a broken PROPERTY_ setting is what inspect helps to fix
+	initRuntime()
+	errResolve := applyPropertyKeys()
+	printInspectProperties(runInspectProperties(*countItems))
+	if errResolve != nil {
+		color.Red("Cannot map the 1C properties: " + errResolve.Error())
+		os.Exit(1)
+	}
+}
+
+// exportCommand runs `1csync export <format> [--out path] [--no-validate]`.
+func exportCommand(args []string) {
+	flags := newCommandFlags("export")
+	out := flags.String("out", "", "file to write, stdout if empty")
+	flags.BoolVar(&_skipONIXValidation, "no-validate", false, "export ONIX without validating it against ONIX_XSD")
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Println("Usage: 1csync export <format> [--out path] [--no-validate]")
+		os.Exit(exitCodeUsage)
+	}
+	format := args[0]
+	parseCommandFlags(flags, args[1:])
+	startCommand(false)
+	runExport(format, *out)
+}
+
+// snapshotCommand runs `1csync snapshot <dir>`.
+func snapshotCommand(args []string) {
+	flags := newCommandFlags("snapshot")
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Println("Usage: 1csync snapshot <dir>")
+		os.Exit(exitCodeUsage)
+	}
+	dir := args[0]
+	parseCommandFlags(flags, args[1:])
+	startCommand(false)
+	runSnapshot(dir)
+	if _outputFormat == outputText {
+		fmt.Println("Saved snapshot to " + dir)
+	}
+}
+
+func serveCommand(ctx context.Context, args []string) {
+	parseCommandFlags(newCommandFlags("serve"), args)
+	loadEnv()
+	acquireRunLock()
+	serve(ctx)
+}
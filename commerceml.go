@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// CommerceML 2 as written by the 1C "exchange with site": import*.xml holds
+// the classifier and the catalog, offers*.xml the prices.
+
+type cmlDocument struct {
+	Groups     []cmlGroup    `xml:"Классификатор>Группы>Группа"`
+	Properties []cmlProperty `xml:"Классификатор>Свойства>Свойство"`
+	// CommerceML 2.03 and older
+	LegacyProperties []cmlProperty `xml:"Классификатор>Свойства>СвойствоНоменклатуры"`
+	Products         []cmlProduct  `xml:"Каталог>Товары>Товар"`
+	Offers           []cmlOffer    `xml:"ПакетПредложений>Предложения>Предложение"`
+}
+
+type cmlGroup struct {
+	ID       string     `xml:"Ид"`
+	Name     string     `xml:"Наименование"`
+	Children []cmlGroup `xml:"Группы>Группа"`
+}
+
+type cmlProperty struct {
+	ID     string        `xml:"Ид"`
+	Name   string        `xml:"Наименование"`
+	Values []cmlRefValue `xml:"ВариантыЗначений>Справочник"`
+}
+
+type cmlRefValue struct {
+	ID    string `xml:"ИдЗначения"`
+	Value string `xml:"Значение"`
+}
+
+type cmlProduct struct {
+	ID           string             `xml:"Ид"`
+	Article      string             `xml:"Артикул"`
+	Name         string             `xml:"Наименование"`
+	Description  string             `xml:"Описание"`
+	Groups       []string           `xml:"Группы>Ид"`
+	Manufacturer cmlManufacturer    `xml:"Изготовитель"`
+	Properties   []cmlPropertyValue `xml:"ЗначенияСвойств>ЗначенияСвойства"`
+	Requisites   []cmlRequisite     `xml:"ЗначенияРеквизитов>ЗначениеРеквизита"`
+	Status       string             `xml:"Статус"`
+	DeletionMark string             `xml:"ПометкаУдаления"`
+}
+
+type cmlManufacturer struct {
+	ID   string `xml:"Ид"`
+	Name string `xml:"Наименование"`
+}
+
+type cmlPropertyValue struct {
+	ID    string `xml:"Ид"`
+	Value string `xml:"Значение"`
+}
+
+type cmlRequisite struct {
+	Name  string `xml:"Наименование"`
+	Value string `xml:"Значение"`
+}
+
+type cmlOffer struct {
+	ID     string     `xml:"Ид"`
+	Prices []cmlPrice `xml:"Цены>Цена"`
+}
+
+type cmlPrice struct {
+	PriceType string `xml:"ИдТипаЦены"`
+	Price     string `xml:"ЦенаЗаЕдиницу"`
+}
+
+// cmlRefKey drops the characteristic from a product or offer id.
+func cmlRefKey(id string) string {
+	return strings.Split(id, "#")[0]
+}
+
+func readCommerceML(pattern string) []cmlDocument {
+	paths, _ := filepath.Glob(pattern)
+	documents := make([]cmlDocument, 0)
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			panic(err)
+		}
+		var document cmlDocument
+		errXML := xml.NewDecoder(file).Decode(&document)
+		file.Close()
+		if errXML != nil {
+			panic(path + ": " + errXML.Error())
+		}
+		logVerbose("Read CommerceML " + path)
+		documents = append(documents, document)
+	}
+	return documents
+}
+
+// cmlNomenclatureItem turns a CommerceML product into a Номенклатура item as
+// OData returns it. Requisites keep their 1C names, so НаименованиеЗаголовок
+// and the like come through when the exchange exports them.
+func cmlNomenclatureItem(product cmlProduct) map[string]interface{} {
+	item := map[string]interface{}{
+		"НаименованиеЗаголовок":   product.Name,
+		"НаименованиеПодаголовок": "",
+		"Описание_Сайт":           product.Description,
+		"ДатаПереиздания":         "0001-01-01T00:00:00",
+	}
+	for _, requisite := range product.Requisites {
+		item[requisite.Name] = requisite.Value
+	}
+	parentKey := emptyRefKey
+	if len(product.Groups) > 0 {
+		parentKey = product.Groups[0]
+	}
+	manufacturerKey := product.Manufacturer.ID
+	if manufacturerKey == "" {
+		manufacturerKey = emptyRefKey
+	}
+	properties := make([]interface{}, 0)
+	for _, property := range product.Properties {
+		properties = append(properties, map[string]interface{}{
+			"Свойство_Key": property.ID,
+			"Значение":     property.Value,
+		})
+	}
+	// CommerceML has no data version, a hash of the product stands in for it
+	body, _ := json.Marshal(product)
+	version := sha1.Sum(body)
+	item["Ref_Key"] = cmlRefKey(product.ID)
+	item["Артикул"] = product.Article
+	item["Description"] = product.Name
+	item["Parent_Key"] = parentKey
+	item["Производитель_Key"] = manufacturerKey
+	item["ДополнительныеРеквизиты"] = properties
+	item["IsFolder"] = false
+	item["DeletionMark"] = product.Status == "Удален" || product.DeletionMark == "true"
+	item["DataVersion"] = hex.EncodeToString(version[:8])
+	return item
+}
+
+// loadCommerceML reads a CommerceML 2 exchange directory into the
+// collections the sync reads from OData. The values of the category
+// property become categories under the first CATEGORY_ROOTS group, as
+// CommerceML does not carry their hierarchy; which property that is is only
+// known once PROPERTY_CATEGORY is resolved, so the values of every property
+// are kept.
+func loadCommerceML(dir string) *offlineSource {
+	imports := readCommerceML(filepath.Join(dir, "import*.xml"))
+	if len(imports) == 0 {
+		panic("No import.xml in " + dir)
+	}
+	offers := readCommerceML(filepath.Join(dir, "offers*.xml"))
+
+	source := &offlineSource{name: "commerceml:" + dir, collections: map[string][]interface{}{
+		pricesCollection:        {},
+		valuesCollection:        {},
+		manufacturersCollection: {},
+		nomenclatureCollection:  {},
+		propertiesCollection:    {},
+	}, categoryValues: make(map[string][]interface{})}
+	add := func(collection string, item map[string]interface{}) {
+		source.collections[collection] = append(source.collections[collection], item)
+	}
+	categoryParent := emptyRefKey
+	if roots := categoryRoots(); len(roots) > 0 {
+		categoryParent = roots[0].key
+	}
+
+	var addGroups func(groups []cmlGroup, parent string)
+	addGroups = func(groups []cmlGroup, parent string) {
+		for _, group := range groups {
+			add(nomenclatureCollection, map[string]interface{}{
+				"Ref_Key":      group.ID,
+				"Description":  group.Name,
+				"Parent_Key":   parent,
+				"Артикул":      "",
+				"IsFolder":     true,
+				"DeletionMark": false,
+			})
+			addGroups(group.Children, group.ID)
+		}
+	}
+	manufacturers := make(map[string]bool)
+	for _, document := range imports {
+		addGroups(document.Groups, emptyRefKey)
+		for _, property := range append(document.Properties, document.LegacyProperties...) {
+			add(propertiesCollection, map[string]interface{}{"Ref_Key": property.ID, "Description": property.Name})
+			for _, value := range property.Values {
+				add(valuesCollection, map[string]interface{}{"Ref_Key": value.ID, "Description": value.Value})
+				source.categoryValues[property.ID] = append(source.categoryValues[property.ID], map[string]interface{}{"Ref_Key": value.ID, "Description": value.Value, "Parent_Key": categoryParent})
+			}
+		}
+		for _, product := range document.Products {
+			add(nomenclatureCollection, cmlNomenclatureItem(product))
+			if product.Manufacturer.ID != "" && !manufacturers[product.Manufacturer.ID] {
+				manufacturers[product.Manufacturer.ID] = true
+				add(manufacturersCollection, map[string]interface{}{"Ref_Key": product.Manufacturer.ID, "Description": product.Manufacturer.Name})
+			}
+		}
+	}
+
+	// the price type ids of the exchange are the 1C ВидЦены refs
+	records := make([]interface{}, 0)
+	for _, document := range offers {
+		for _, offer := range document.Offers {
+			for _, price := range offer.Prices {
+				value, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(price.Price), ",", ".", 1), 64)
+				if err != nil {
+					color.Yellow("Invalid CommerceML price of " + offer.ID + ": " + price.Price)
+					continue
+				}
+				records = append(records, map[string]interface{}{
+					"Номенклатура_Key": cmlRefKey(offer.ID),
+					"ВидЦены_Key":      price.PriceType,
+					"Цена":             value,
+					"Period":           "0001-01-01T00:00:00",
+				})
+			}
+		}
+	}
+	add(pricesCollection, map[string]interface{}{"RecordSet": records})
+
+	logVerbose(strconv.Itoa(len(source.collections[nomenclatureCollection])) + " Номенклатура items read from " + dir)
+	return source
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronScheduleErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		valid      bool
+	}{
+		{"0 3 * * *", true},
+		{"*/15 * * * *", true},
+		{"0 9-18/3 * * 1-5", true},
+		{"0 0 1,15 * 7", true},
+		{"0 3 * *", false},
+		{"0 3 * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"a * * * *", false},
+		{"0 0 30 2 *", false},
+		{"0 0 31 4 *", false},
+		{"0 0 29 2 *", true},
+	}
+	for _, test := range tests {
+		_, err := parseCronSchedule(test.expression)
+		if (err == nil) != test.valid {
+			t.Errorf("parseCronSchedule(%q) error = %v, want valid %v", test.expression, err, test.valid)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// 2024-03-15 is a Friday
+	from := time.Date(2024, 3, 15, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expression string
+		want       time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, 3, 15, 10, 15, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2024, 3, 16, 3, 0, 0, 0, time.UTC)},
+		{"7 10 * * *", time.Date(2024, 3, 16, 10, 7, 0, 0, time.UTC)},
+		{"0 9 * * 1", time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2024, 3, 17, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// a restricted day-of-month and day-of-week match either
+		{"0 0 20 * 6", time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		schedule, err := parseCronSchedule(test.expression)
+		if err != nil {
+			t.Fatalf("parseCronSchedule(%q): %v", test.expression, err)
+		}
+		if got := schedule.next(from); !got.Equal(test.want) {
+			t.Errorf("%q next after %s = %s, want %s", test.expression, from, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// doctorCheck is the outcome of one configuration or connectivity check.
+type doctorCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// runCheck turns a panic of check into a failed check.
+func runCheck(name string, check func() string) (result doctorCheck) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = doctorCheck{Name: name, OK: false, Detail: fmt.Sprint(r)}
+		}
+	}()
+	return doctorCheck{Name: name, OK: true, Detail: check()}
+}
+
+// runDoctor checks the configuration and that both 1C and Sylius answer,
+// without changing anything.
+func runDoctor() []doctorCheck {
+	checks := make([]doctorCheck, 0)
+	missing := make([]string, 0)
+	for _, name := range []string{"SYLIUS_HOST", "SYLIUS_CLIENT_ID", "SYLIUS_CLIENT_SECRET", "SYLIUS_API_USERNAME", "SYLIUS_API_PASSWORD", "1C_HOST", "1C_LOGIN", "1C_PASSWORD"} {
+		if value, _ := os.LookupEnv(name); value == "" {
+			missing = append(missing, name)
+		}
+	}
+	checks = append(checks, runCheck("environment", func() string {
+		if len(missing) > 0 {
+			panic("missing " + strings.Join(missing, ", "))
+		}
+		return "all required variables are set"
+	}))
+	checks = append(checks, runCheck("rate limits", func() string {
+		syliusLimiter := rateLimiterFromEnv("Sylius", "SYLIUS")
+		odinCLimiter := rateLimiterFromEnv("1C", "1C")
+		return fmt.Sprintf("Sylius %.2f req/s, 1C %.2f req/s (0 is unlimited)", syliusLimiter.rps, odinCLimiter.rps)
+	}))
+	// the few requests of the checks below need no limits
+	if _syliusLimiter == nil {
+		_syliusLimiter = newRateLimiter("Sylius", 0, 0)
+	}
+	if _odinCLimiter == nil {
+		_odinCLimiter = newRateLimiter("1C", 0, 0)
+	}
+	checks = append(checks, runCheck("schedules", func() string {
+		runHistorySizeFromEnv()
+		next := make([]string, 0)
+		for name, defaultValue := range map[string]string{
+			"SYNC_SCHEDULE_FULL":        "0 3 * * *",
+			"SYNC_SCHEDULE_INCREMENTAL": "*/15 * * * *",
+		} {
+			if schedule := scheduleFromEnv(name, defaultValue); schedule != nil {
+				next = append(next, name+" next at "+schedule.next(time.Now()).Format(time.RFC3339))
+			}
+		}
+		sort.Strings(next)
+		if len(next) == 0 {
+			return "no scheduled syncs"
+		}
+		return strings.Join(next, ", ")
+	}))
+	checks = append(checks, runCheck("Sylius", func() string {
+		fetchSyliusToken()
+		taxons := make([]string, 0)
+		for _, root := range categoryRoots() {
+			taxon := syliusRequest("GET", "/api/v1/taxons/"+root.taxon, nil, "application/json")
+			if taxon["code"] != root.taxon {
+				panic("the " + root.taxon + " taxon of CATEGORY_ROOTS is missing")
+			}
+			taxons = append(taxons, root.taxon)
+		}
+		return "authenticated, category root taxons found: " + strings.Join(taxons, ", ")
+	}))
+	checks = append(checks, runCheck("1C", func() string {
+		items := odinCRequest("GET", nomenclatureURL+"&$top=1", nil)
+		if _, ok := items["value"].([]interface{}); !ok {
+			panic("unexpected response from the Номенклатура catalog")
+		}
+		return "Номенклатура catalog is readable"
+	}))
+	checks = append(checks, runCheck("1C properties", func() string {
+		if err := applyPropertyKeys(); err != nil {
+			panic(err)
+		}
+		return "the PROPERTY_ settings resolve"
+	}))
+	checks = append(checks, runCheck("run lock", func() string {
+		content, err := ioutil.ReadFile(lockPath())
+		if os.IsNotExist(err) {
+			return "no sync is running"
+		}
+		return "held by PID " + strings.TrimSpace(string(content)) + " (" + lockPath() + ")"
+	}))
+	return checks
+}
+
+func printDoctor(checks []doctorCheck) {
+	if _outputFormat == outputJSON {
+		body, _ := json.MarshalIndent(checks, "", "  ")
+		fmt.Println(string(body))
+		return
+	}
+	for _, check := range checks {
+		if check.OK {
+			color.Green("OK    %s: %s", check.Name, check.Detail)
+		} else {
+			color.Red("FAIL  %s: %s", check.Name, check.Detail)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// exportedProduct is a 1C product as the sync sees it: the item, its
+// `_`-suffixed variants and the current price of each of them.
+type exportedProduct struct {
+	Product  map[string]interface{}   `json:"product"`
+	Variants []map[string]interface{} `json:"variants"`
+	Prices   map[string]float64       `json:"prices"`
+}
+
+func collectExportedProducts() []exportedProduct {
+	syncPrices()
+	exported := make([]exportedProduct, 0)
+	for _, sourceProduct := range fetchProducts("Артикул ne ''") {
+		slug := sourceProduct.article
+		product := exportedProduct{
+			Product:  sourceProduct.raw,
+			Variants: make([]map[string]interface{}, 0),
+			Prices:   make(map[string]float64),
+		}
+		for _, item := range append([]nomenclatureItem{sourceProduct}, _variants[slug]...) {
+			if item.article != slug {
+				product.Variants = append(product.Variants, item.raw)
+			}
+			if priceItem, ok := _prices[item.refKey]; ok {
+				product.Prices[item.article] = priceItem.price
+			}
+		}
+		exported = append(exported, product)
+	}
+	return exported
+}
+
+func exportJSON(writer io.Writer) {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(collectExportedProducts()); err != nil {
+		panic(err)
+	}
+}
+
+// exporters maps the formats of `1csync export <format>` to their writers.
+var exporters = map[string]func(writer io.Writer){
+	"json": exportJSON,
+	"yml":  exportYML,
+	"onix": exportONIX,
+	// Google Merchant Center
+	"merchant":     exportMerchantXML,
+	"merchant-tsv": exportMerchantTSV,
+}
+
+// runExport writes the export to path, or to stdout if path is empty.
+func runExport(format string, path string) {
+	exporter, ok := exporters[format]
+	if !ok {
+		panic("Unknown export format: " + format)
+	}
+	writer := io.Writer(os.Stdout)
+	if path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			panic(err)
+		}
+		defer file.Close()
+		writer = file
+	}
+	exporter(writer)
+}
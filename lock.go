@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/fatih/color"
+	"github.com/mozillazg/go-slugify"
+)
+
+// exitCodeLocked is returned when another sync holds the run lock
+// (EX_TEMPFAIL, so cron supervisors can tell it from a failed run).
+const exitCodeLocked = 75
+
+var _lockFile string
+
+// lockPath is keyed on the Sylius host, so syncs into different shops
+// from the same machine do not block each other.
+func lockPath() string {
+	if path, ok := os.LookupEnv("LOCK_FILE"); ok && path != "" {
+		return path
+	}
+	syliusHost, _ := os.LookupEnv("SYLIUS_HOST")
+	return filepath.Join(os.TempDir(), "1csync-"+slugify.Slugify(syliusHost)+".lock")
+}
+
+// processAlive tells whether pid runs; a process of another user refuses
+// the signal but is alive all the same.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	errSignal := process.Signal(syscall.Signal(0))
+	return errSignal == nil || errors.Is(errSignal, syscall.EPERM)
+}
+
+// acquireRunLock creates the lock file with our PID, taking over lock files
+// left behind by processes that are no longer running. It exits the process
+// if another live sync holds the lock.
+//
+// The PID is written to a temporary file first and then linked into place,
+// so the lock file never exists without a PID in it.
+func acquireRunLock() {
+	path := lockPath()
+	temp, errTemp := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if errTemp != nil {
+		panic(errTemp)
+	}
+	fmt.Fprint(temp, os.Getpid())
+	temp.Close()
+	defer os.Remove(temp.Name())
+	for {
+		err := os.Link(temp.Name(), path)
+		if err == nil {
+			_lockFile = path
+			return
+		}
+		if !os.IsExist(err) {
+			panic(err)
+		}
+		content, _ := ioutil.ReadFile(path)
+		pid, errPid := strconv.Atoi(strings.TrimSpace(string(content)))
+		if errPid == nil && processAlive(pid) {
+			color.Red("Another sync is already running (PID %d, lock file %s)", pid, path)
+			os.Remove(temp.Name())
+			os.Exit(exitCodeLocked)
+		}
+		logVerbose("Removing stale lock file " + path)
+		if errRemove := os.Remove(path); errRemove != nil && !os.IsNotExist(errRemove) {
+			panic(errRemove)
+		}
+	}
+}
+
+func releaseRunLock() {
+	if _lockFile == "" {
+		return
+	}
+	os.Remove(_lockFile)
+	_lockFile = ""
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"strings"
+)
+
+// merchantItem is a Google Merchant Center item; the xml tags are those of
+// the RSS feed, the tsv order is merchantColumns.
+type merchantItem struct {
+	ID                    string `xml:"g:id"`
+	Title                 string `xml:"g:title"`
+	Description           string `xml:"g:description,omitempty"`
+	Link                  string `xml:"g:link"`
+	Availability          string `xml:"g:availability"`
+	Price                 string `xml:"g:price"`
+	SalePrice             string `xml:"g:sale_price,omitempty"`
+	GTIN                  string `xml:"g:gtin,omitempty"`
+	Brand                 string `xml:"g:brand,omitempty"`
+	IdentifierExists      string `xml:"g:identifier_exists"`
+	Condition             string `xml:"g:condition"`
+	GoogleProductCategory string `xml:"g:google_product_category"`
+	ProductType           string `xml:"g:product_type,omitempty"`
+	ItemGroupID           string `xml:"g:item_group_id,omitempty"`
+}
+
+var merchantColumns = []string{
+	"id", "title", "description", "link", "availability", "price", "sale_price", "gtin", "brand",
+	"identifier_exists", "condition", "google_product_category", "product_type", "item_group_id",
+}
+
+func (item merchantItem) columns() []string {
+	return []string{
+		item.ID, item.Title, item.Description, item.Link, item.Availability, item.Price, item.SalePrice, item.GTIN, item.Brand,
+		item.IdentifierExists, item.Condition, item.GoogleProductCategory, item.ProductType, item.ItemGroupID,
+	}
+}
+
+type merchantFeed struct {
+	XMLName xml.Name       `xml:"rss"`
+	Version string         `xml:"version,attr"`
+	XmlnsG  string         `xml:"xmlns:g,attr"`
+	Title   string         `xml:"channel>title"`
+	Link    string         `xml:"channel>link"`
+	Items   []merchantItem `xml:"channel>item"`
+}
+
+func formatMerchantPrice(price float64) string {
+	return formatPrice(price) + " RUB"
+}
+
+// collectMerchantItems builds one item per variant. A variant is in stock
+// when it has a price and is not hidden; variants without any price are left
+// out as Google rejects items without one.
+func collectMerchantItems() []merchantItem {
+	products, categories := collectCatalog()
+	categoryNames := make(map[string]string)
+	for _, category := range categories {
+		categoryNames[category.code] = strings.Join(category.path, " > ")
+	}
+
+	items := make([]merchantItem, 0)
+	for _, product := range products {
+		title := product.name
+		if product.subtitle != "" {
+			title += ". " + product.subtitle
+		}
+		for _, variant := range product.variants {
+			item := merchantItem{
+				ID:                    variant.article,
+				Title:                 title,
+				Description:           product.description,
+				Link:                  productURL(product.article),
+				Availability:          "in_stock",
+				Brand:                 product.publisher,
+				IdentifierExists:      "no",
+				Condition:             "new",
+				GoogleProductCategory: envOrDefault("MERCHANT_PRODUCT_CATEGORY", "784"),
+				ProductType:           categoryNames[product.category],
+			}
+			if len(product.variants) > 1 {
+				item.ItemGroupID = product.article
+			}
+			if variantTitle, ok := variantTypes[variant.variantType].(map[string]interface{})["title"].(string); ok && variant.variantType != "default" {
+				item.Title += " (" + variantTitle + ")"
+			}
+			switch {
+			case variant.price > 0 && variant.originalPrice > variant.price:
+				item.Price = formatMerchantPrice(variant.originalPrice)
+				item.SalePrice = formatMerchantPrice(variant.price)
+			case variant.price > 0:
+				item.Price = formatMerchantPrice(variant.price)
+			case variant.originalPrice > 0:
+				item.Price = formatMerchantPrice(variant.originalPrice)
+				item.Availability = "out_of_stock"
+			default:
+				logVerbose("Variant without a price left out of the Merchant feed: " + variant.article)
+				continue
+			}
+			if variant.hidden {
+				item.Availability = "out_of_stock"
+			}
+			// the ISBN in 1C is the one of the printed book
+			if variant.variantType == "default" {
+				if isbn := normalizeISBN13(product.isbn); isbn != "" {
+					item.GTIN = isbn
+					item.IdentifierExists = "yes"
+				}
+			}
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// exportMerchantXML writes a Google Merchant Center RSS 2.0 feed.
+func exportMerchantXML(writer io.Writer) {
+	shopName, _ := os.LookupEnv("YML_SHOP_NAME")
+	shopURL, _ := os.LookupEnv("SHOP_URL")
+	feed := merchantFeed{
+		Version: "2.0",
+		XmlnsG:  "http://base.google.com/ns/1.0",
+		Title:   shopName,
+		Link:    shopURL,
+		Items:   collectMerchantItems(),
+	}
+	io.WriteString(writer, xml.Header)
+	encoder := xml.NewEncoder(writer)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		panic(err)
+	}
+	io.WriteString(writer, "\n")
+}
+
+// exportMerchantTSV writes the same feed as a tab separated file.
+func exportMerchantTSV(writer io.Writer) {
+	// tabs and newlines would break the row
+	sanitizer := strings.NewReplacer("\t", " ", "\r\n", " ", "\n", " ", "\r", " ")
+	if _, err := io.WriteString(writer, strings.Join(merchantColumns, "\t")+"\n"); err != nil {
+		panic(err)
+	}
+	for _, item := range collectMerchantItems() {
+		columns := item.columns()
+		for i, column := range columns {
+			columns[i] = sanitizer.Replace(column)
+		}
+		if _, err := io.WriteString(writer, strings.Join(columns, "\t")+"\n"); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The 1C items the sync reads, decoded once from the OData responses. A
+// null decodes to the zero value; a field of an unexpected type is an error
+// naming the item and the field.
+
+// propertyValue is an entry of ДополнительныеРеквизиты. value is Значение
+// as sent, the ref key for reference values; text gives what to show.
+type propertyValue struct {
+	key       string
+	value     string
+	valueType string
+}
+
+// text decodes the value by its Значение_Type: refs to the values catalog
+// resolve to their name, numbers lose trailing zeros and dates become
+// 2006-01-02, the format of Sylius date attributes. Refs to other catalogs
+// have no text.
+func (property propertyValue) text() string {
+	switch {
+	case strings.HasSuffix(property.valueType, ".Catalog_ЗначенияСвойствОбъектов"):
+		name, ok := _values[property.value]
+		if !ok && property.value != emptyRefKey {
+			logVerbose("Unknown value " + property.value + " of property " + property.key)
+		}
+		return name
+	case strings.HasPrefix(property.valueType, "StandardODATA."):
+		logVerbose("Property " + property.key + " refers to " + property.valueType + ", leaving it out")
+		return ""
+	case property.valueType == "Edm.DateTime":
+		date, err := time.Parse("2006-01-02T15:04:05", property.value)
+		if err != nil || date.Year() <= 1 {
+			return ""
+		}
+		return date.Format("2006-01-02")
+	case property.valueType == "Edm.Double" || property.valueType == "Edm.Decimal" || strings.HasPrefix(property.valueType, "Edm.Int"):
+		number, err := strconv.ParseFloat(property.value, 64)
+		if err != nil {
+			return property.value
+		}
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	// sources without Значение_Type, like CommerceML, send refs as bare keys
+	if name, ok := _values[property.value]; ok && guidPattern.MatchString(property.value) {
+		return name
+	}
+	return property.value
+}
+
+// nomenclatureItem is a Номенклатура item: a product, a variant or a folder.
+type nomenclatureItem struct {
+	refKey          string
+	article         string
+	parentKey       string
+	description     string
+	title           string
+	subtitle        string
+	siteDescription string
+	manufacturerKey string
+	// publishDate is zero when ДатаПереиздания is not filled
+	publishDate  time.Time
+	dataVersion  string
+	isFolder     bool
+	deletionMark bool
+	properties   []propertyValue
+	// raw is the item as 1C returned it, for the JSON export
+	raw map[string]interface{}
+	// err is the first decoding error; such items are reported as failed
+	// but still count as present in 1C
+	err error
+}
+
+// property returns the value of an additional property, "" if not set.
+func (item nomenclatureItem) property(key string) string {
+	value := ""
+	for _, property := range item.properties {
+		if property.key == key {
+			value = property.value
+		}
+	}
+	return value
+}
+
+// priceRecord is a ЦеныНоменклатуры record.
+type priceRecord struct {
+	productKey string
+	priceType  string
+	price      float64
+	period     time.Time
+}
+
+// referenceItem is an item of a reference catalog: a property value, a
+// publisher, a category or a folder.
+type referenceItem struct {
+	refKey      string
+	parentKey   string
+	description string
+}
+
+// odataDecoder reads the fields of an OData item, keeping the first error.
+type odataDecoder struct {
+	name string
+	item map[string]interface{}
+	err  error
+}
+
+func (decoder *odataDecoder) fail(field string, reason string) {
+	if decoder.err == nil {
+		decoder.err = fmt.Errorf("%s: %s %s", decoder.name, field, reason)
+	}
+}
+
+func (decoder *odataDecoder) string(field string) string {
+	switch value := decoder.item[field].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		decoder.fail(field, fmt.Sprintf("is %T, not a string", value))
+		return ""
+	}
+}
+
+func (decoder *odataDecoder) bool(field string) bool {
+	switch value := decoder.item[field].(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	default:
+		decoder.fail(field, fmt.Sprintf("is %T, not a boolean", value))
+		return false
+	}
+}
+
+func (decoder *odataDecoder) float(field string) float64 {
+	switch value := decoder.item[field].(type) {
+	case nil:
+		return 0
+	case float64:
+		return value
+	case string:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			decoder.fail(field, "is not a number: "+value)
+		}
+		return number
+	default:
+		decoder.fail(field, fmt.Sprintf("is %T, not a number", value))
+		return 0
+	}
+}
+
+// time reads a 1C date, which has no zone; the empty 1C date is zero.
+func (decoder *odataDecoder) time(field string) time.Time {
+	value := decoder.string(field)
+	if value == "" || value == "0001-01-01T00:00:00" {
+		return time.Time{}
+	}
+	date, err := time.Parse("2006-01-02T15:04:05", value)
+	if err != nil {
+		decoder.fail(field, "is not a date: "+value)
+	}
+	return date
+}
+
+func (decoder *odataDecoder) list(field string) []map[string]interface{} {
+	items := make([]map[string]interface{}, 0)
+	switch value := decoder.item[field].(type) {
+	case nil:
+	case []interface{}:
+		for _, itemRaw := range value {
+			item, ok := itemRaw.(map[string]interface{})
+			if !ok {
+				decoder.fail(field, fmt.Sprintf("holds %T, not an object", itemRaw))
+				continue
+			}
+			items = append(items, item)
+		}
+	default:
+		decoder.fail(field, fmt.Sprintf("is %T, not a list", value))
+	}
+	return items
+}
+
+// propertyString reads Значение, which 1C sends as a string, a number or a
+// boolean depending on the property.
+func (decoder *odataDecoder) propertyString(field string) string {
+	switch value := decoder.item[field].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		decoder.fail(field, fmt.Sprintf("is %T, not a value", value))
+		return ""
+	}
+}
+
+func decodeNomenclatureItem(raw map[string]interface{}) nomenclatureItem {
+	name, _ := raw["Артикул"].(string)
+	if name == "" {
+		name, _ = raw["Ref_Key"].(string)
+	}
+	decoder := &odataDecoder{name: name, item: raw}
+	item := nomenclatureItem{
+		refKey:          decoder.string("Ref_Key"),
+		article:         decoder.string("Артикул"),
+		parentKey:       decoder.string("Parent_Key"),
+		description:     decoder.string("Description"),
+		title:           decoder.string("НаименованиеЗаголовок"),
+		subtitle:        decoder.string("НаименованиеПодаголовок"),
+		siteDescription: decoder.string("Описание_Сайт"),
+		manufacturerKey: decoder.string("Производитель_Key"),
+		publishDate:     decoder.time("ДатаПереиздания"),
+		dataVersion:     decoder.string("DataVersion"),
+		isFolder:        decoder.bool("IsFolder"),
+		deletionMark:    decoder.bool("DeletionMark"),
+		raw:             raw,
+	}
+	for _, property := range decoder.list("ДополнительныеРеквизиты") {
+		propertyDecoder := &odataDecoder{name: name, item: property}
+		item.properties = append(item.properties, propertyValue{
+			key:       propertyDecoder.string("Свойство_Key"),
+			value:     propertyDecoder.propertyString("Значение"),
+			valueType: propertyDecoder.string("Значение_Type"),
+		})
+		if propertyDecoder.err != nil && decoder.err == nil {
+			decoder.err = propertyDecoder.err
+		}
+	}
+	item.err = decoder.err
+	return item
+}
+
+func decodePriceRecord(raw map[string]interface{}) (priceRecord, error) {
+	name, _ := raw["Номенклатура_Key"].(string)
+	decoder := &odataDecoder{name: "price of " + name, item: raw}
+	record := priceRecord{
+		productKey: decoder.string("Номенклатура_Key"),
+		priceType:  decoder.string("ВидЦены_Key"),
+		price:      decoder.float("Цена"),
+		period:     decoder.time("Period"),
+	}
+	return record, decoder.err
+}
+
+func decodeReferenceItem(raw map[string]interface{}) (referenceItem, error) {
+	name, _ := raw["Ref_Key"].(string)
+	decoder := &odataDecoder{name: name, item: raw}
+	item := referenceItem{
+		refKey:      decoder.string("Ref_Key"),
+		parentKey:   decoder.string("Parent_Key"),
+		description: decoder.string("Description"),
+	}
+	return item, decoder.err
+}
+
+// odataValues returns the objects of the value list of an OData response.
+func odataValues(response map[string]interface{}) []map[string]interface{} {
+	if _, ok := response["value"]; !ok {
+		panic(fmt.Sprint("Unexpected 1C response: ", response))
+	}
+	decoder := &odataDecoder{name: "1C response", item: response}
+	values := decoder.list("value")
+	if decoder.err != nil {
+		panic(decoder.err)
+	}
+	return values
+}
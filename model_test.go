@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestODataDecoderNulls(t *testing.T) {
+	decoder := &odataDecoder{name: "ethics-10", item: map[string]interface{}{
+		"Description":     nil,
+		"IsFolder":        nil,
+		"Цена":            nil,
+		"ДатаПереиздания": "0001-01-01T00:00:00",
+		"ДополнительныеРеквизиты": nil,
+	}}
+	if got := decoder.string("Description"); got != "" {
+		t.Errorf("string of null = %q", got)
+	}
+	if got := decoder.string("Absent"); got != "" {
+		t.Errorf("string of an absent field = %q", got)
+	}
+	if decoder.bool("IsFolder") {
+		t.Error("bool of null is true")
+	}
+	if got := decoder.float("Цена"); got != 0 {
+		t.Errorf("float of null = %g", got)
+	}
+	if got := decoder.time("ДатаПереиздания"); !got.IsZero() {
+		t.Errorf("time of the empty 1C date = %s", got)
+	}
+	if got := decoder.list("ДополнительныеРеквизиты"); len(got) != 0 {
+		t.Errorf("list of null = %v", got)
+	}
+	if decoder.err != nil {
+		t.Errorf("nulls gave an error: %v", decoder.err)
+	}
+}
+
+func TestODataDecoderMismatches(t *testing.T) {
+	item := map[string]interface{}{
+		"Description":     12.0,
+		"IsFolder":        "false",
+		"Цена":            "1,5",
+		"ДатаПереиздания": "15.03.2024",
+		"ДополнительныеРеквизиты": []interface{}{"not an object"},
+		"Значение": []interface{}{},
+	}
+	tests := []struct {
+		field  string
+		decode func(decoder *odataDecoder)
+		want   string
+	}{
+		{"Description", func(decoder *odataDecoder) { decoder.string("Description") }, "ethics-10: Description is float64, not a string"},
+		{"IsFolder", func(decoder *odataDecoder) { decoder.bool("IsFolder") }, "ethics-10: IsFolder is string, not a boolean"},
+		{"Цена", func(decoder *odataDecoder) { decoder.float("Цена") }, "ethics-10: Цена is not a number: 1,5"},
+		{"ДатаПереиздания", func(decoder *odataDecoder) { decoder.time("ДатаПереиздания") }, "ethics-10: ДатаПереиздания is not a date: 15.03.2024"},
+		{"ДополнительныеРеквизиты", func(decoder *odataDecoder) { decoder.list("ДополнительныеРеквизиты") }, "ethics-10: ДополнительныеРеквизиты holds string, not an object"},
+		{"Значение", func(decoder *odataDecoder) { decoder.propertyString("Значение") }, "ethics-10: Значение is []interface {}, not a value"},
+	}
+	for _, test := range tests {
+		decoder := &odataDecoder{name: "ethics-10", item: item}
+		test.decode(decoder)
+		if decoder.err == nil || decoder.err.Error() != test.want {
+			t.Errorf("%s: error = %v, want %q", test.field, decoder.err, test.want)
+		}
+	}
+}
+
+func TestODataDecoderKeepsFirstError(t *testing.T) {
+	decoder := &odataDecoder{name: "ethics-10", item: map[string]interface{}{"Артикул": 1.0, "IsFolder": "yes"}}
+	decoder.string("Артикул")
+	decoder.bool("IsFolder")
+	if want := "ethics-10: Артикул is float64, not a string"; decoder.err == nil || decoder.err.Error() != want {
+		t.Errorf("error = %v, want %q", decoder.err, want)
+	}
+}
+
+func TestDecodeNomenclatureItem(t *testing.T) {
+	item := decodeNomenclatureItem(map[string]interface{}{
+		"Ref_Key":         "8b1a6c7e-0c3b-11eb-8191-74d02b904d6f",
+		"Артикул":         "ethics-10",
+		"ДатаПереиздания": "2024-03-15T00:00:00",
+		"DeletionMark":    false,
+		"ДополнительныеРеквизиты": []interface{}{
+			map[string]interface{}{"Свойство_Key": "pages", "Значение": 320.0, "Значение_Type": "Edm.Int32"},
+			map[string]interface{}{"Свойство_Key": "hidden", "Значение": true, "Значение_Type": "Edm.Boolean"},
+		},
+	})
+	if item.err != nil {
+		t.Fatalf("err = %v", item.err)
+	}
+	if want := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC); !item.publishDate.Equal(want) {
+		t.Errorf("publishDate = %s, want %s", item.publishDate, want)
+	}
+	if got := item.property("pages"); got != "320" {
+		t.Errorf("pages = %q, want 320", got)
+	}
+	if got := item.property("hidden"); got != "true" {
+		t.Errorf("hidden = %q, want true", got)
+	}
+
+	broken := decodeNomenclatureItem(map[string]interface{}{
+		"Артикул": "ethics-10",
+		"ДополнительныеРеквизиты": []interface{}{
+			map[string]interface{}{"Свойство_Key": 5.0},
+		},
+	})
+	if broken.err == nil {
+		t.Error("a property with a numeric key decoded without an error")
+	}
+}
+
+func TestPropertyValueText(t *testing.T) {
+	_values = map[string]string{
+		"a1b2c3d4-0000-11eb-8191-74d02b904d6f": "Твёрдая",
+	}
+	tests := []struct {
+		name  string
+		value propertyValue
+		want  string
+	}{
+		{"value ref", propertyValue{value: "a1b2c3d4-0000-11eb-8191-74d02b904d6f", valueType: "StandardODATA.Catalog_ЗначенияСвойствОбъектов"}, "Твёрдая"},
+		{"unknown value ref", propertyValue{value: "ffffffff-0000-11eb-8191-74d02b904d6f", valueType: "StandardODATA.Catalog_ЗначенияСвойствОбъектов"}, ""},
+		{"empty value ref", propertyValue{value: emptyRefKey, valueType: "StandardODATA.Catalog_ЗначенияСвойствОбъектов"}, ""},
+		{"ref to another catalog", propertyValue{value: "a1b2c3d4-0000-11eb-8191-74d02b904d6f", valueType: "StandardODATA.Catalog_Пользователи"}, ""},
+		{"date", propertyValue{value: "2024-03-15T00:00:00", valueType: "Edm.DateTime"}, "2024-03-15"},
+		{"empty date", propertyValue{value: "0001-01-01T00:00:00", valueType: "Edm.DateTime"}, ""},
+		{"double", propertyValue{value: "320.000", valueType: "Edm.Double"}, "320"},
+		{"decimal", propertyValue{value: "0.45", valueType: "Edm.Decimal"}, "0.45"},
+		{"int", propertyValue{value: "12", valueType: "Edm.Int32"}, "12"},
+		{"not a number", propertyValue{value: "n/a", valueType: "Edm.Double"}, "n/a"},
+		{"string", propertyValue{value: "978-5-00000-000-0", valueType: "Edm.String"}, "978-5-00000-000-0"},
+		{"bare ref without type", propertyValue{value: "a1b2c3d4-0000-11eb-8191-74d02b904d6f"}, "Твёрдая"},
+		{"text without type", propertyValue{value: "Мягкая"}, "Мягкая"},
+	}
+	for _, test := range tests {
+		if got := test.value.text(); got != test.want {
+			t.Errorf("%s: text() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
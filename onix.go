@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// ONIX 3.0 reference tags; the element order follows the schema.
+
+type onixMessage struct {
+	XMLName  xml.Name      `xml:"ONIXMessage"`
+	Release  string        `xml:"release,attr"`
+	Xmlns    string        `xml:"xmlns,attr"`
+	Header   onixHeader    `xml:"Header"`
+	Products []onixProduct `xml:"Product"`
+}
+
+type onixHeader struct {
+	SenderName   string `xml:"Sender>SenderName"`
+	SentDateTime string `xml:"SentDateTime"`
+}
+
+type onixProduct struct {
+	RecordReference    string                `xml:"RecordReference"`
+	NotificationType   string                `xml:"NotificationType"`
+	ProductIdentifiers []onixProductID       `xml:"ProductIdentifier"`
+	DescriptiveDetail  onixDescriptiveDetail `xml:"DescriptiveDetail"`
+	CollateralDetail   *onixCollateralDetail `xml:"CollateralDetail,omitempty"`
+	PublishingDetail   *onixPublishingDetail `xml:"PublishingDetail,omitempty"`
+	ProductSupply      *onixProductSupply    `xml:"ProductSupply,omitempty"`
+}
+
+type onixProductID struct {
+	ProductIDType string `xml:"ProductIDType"`
+	IDValue       string `xml:"IDValue"`
+}
+
+type onixDescriptiveDetail struct {
+	ProductComposition string            `xml:"ProductComposition"`
+	ProductForm        string            `xml:"ProductForm"`
+	Measures           []onixMeasure     `xml:"Measure"`
+	TitleDetail        onixTitleDetail   `xml:"TitleDetail"`
+	Contributors       []onixContributor `xml:"Contributor"`
+	LanguageRole       string            `xml:"Language>LanguageRole"`
+	LanguageCode       string            `xml:"Language>LanguageCode"`
+	Extents            []onixExtent      `xml:"Extent"`
+}
+
+type onixMeasure struct {
+	MeasureType     string `xml:"MeasureType"`
+	Measurement     string `xml:"Measurement"`
+	MeasureUnitCode string `xml:"MeasureUnitCode"`
+}
+
+type onixTitleDetail struct {
+	TitleType         string `xml:"TitleType"`
+	TitleElementLevel string `xml:"TitleElement>TitleElementLevel"`
+	TitleText         string `xml:"TitleElement>TitleText"`
+	Subtitle          string `xml:"TitleElement>Subtitle,omitempty"`
+}
+
+type onixContributor struct {
+	SequenceNumber  int    `xml:"SequenceNumber"`
+	ContributorRole string `xml:"ContributorRole"`
+	PersonName      string `xml:"PersonName"`
+}
+
+type onixExtent struct {
+	ExtentType  string `xml:"ExtentType"`
+	ExtentValue string `xml:"ExtentValue"`
+	ExtentUnit  string `xml:"ExtentUnit"`
+}
+
+type onixCollateralDetail struct {
+	TextType        string `xml:"TextContent>TextType"`
+	ContentAudience string `xml:"TextContent>ContentAudience"`
+	Text            string `xml:"TextContent>Text"`
+}
+
+type onixPublishingDetail struct {
+	Publisher          *onixPublisher `xml:"Publisher,omitempty"`
+	PublishingDateRole string         `xml:"PublishingDate>PublishingDateRole,omitempty"`
+	PublishingDate     string         `xml:"PublishingDate>Date,omitempty"`
+}
+
+type onixPublisher struct {
+	PublishingRole string `xml:"PublishingRole"`
+	PublisherName  string `xml:"PublisherName"`
+}
+
+type onixProductSupply struct {
+	SupplierRole        string      `xml:"SupplyDetail>Supplier>SupplierRole"`
+	SupplierName        string      `xml:"SupplyDetail>Supplier>SupplierName"`
+	ProductAvailability string      `xml:"SupplyDetail>ProductAvailability"`
+	Prices              []onixPrice `xml:"SupplyDetail>Price"`
+}
+
+type onixPrice struct {
+	PriceType    string `xml:"PriceType"`
+	PriceAmount  string `xml:"PriceAmount"`
+	CurrencyCode string `xml:"CurrencyCode"`
+}
+
+// normalizeISBN13 strips the hyphens of an ISBN and returns it if it is a
+// valid ISBN-13, or "" otherwise.
+func normalizeISBN13(isbn string) string {
+	digits := strings.NewReplacer("-", "", " ", "").Replace(isbn)
+	if len(digits) != 13 {
+		return ""
+	}
+	sum := 0
+	for i, r := range digits {
+		if r < '0' || r > '9' {
+			return ""
+		}
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += int(r-'0') * weight
+	}
+	if sum%10 != 0 {
+		return ""
+	}
+	return digits
+}
+
+// onixProductForm maps a variant to ONIX list 150, telling hardbacks from
+// paperbacks by the cover type.
+func onixProductForm(product catalogProduct, variant catalogVariant) string {
+	switch variant.variantType {
+	case "ebook":
+		return "ED"
+	case "audio":
+		return "AJ"
+	case "video":
+		return "VZ"
+	}
+	coverType := strings.ToLower(product.coverType)
+	if strings.Contains(coverType, "тверд") || strings.Contains(coverType, "твёрд") {
+		return "BB"
+	}
+	if strings.Contains(coverType, "мягк") {
+		return "BC"
+	}
+	return "BA"
+}
+
+func newONIXProduct(product catalogProduct, variant catalogVariant) onixProduct {
+	recordPrefix := envOrDefault("ONIX_RECORD_PREFIX", "1csync")
+	onix := onixProduct{
+		RecordReference:    recordPrefix + "." + variant.article,
+		NotificationType:   "03",
+		ProductIdentifiers: []onixProductID{{ProductIDType: "01", IDValue: variant.article}},
+		DescriptiveDetail: onixDescriptiveDetail{
+			ProductComposition: "00",
+			ProductForm:        onixProductForm(product, variant),
+			TitleDetail: onixTitleDetail{
+				TitleType:         "01",
+				TitleElementLevel: "01",
+				TitleText:         product.name,
+				Subtitle:          product.subtitle,
+			},
+			LanguageRole: "01",
+			LanguageCode: "rus",
+		},
+	}
+	// the ISBN in 1C is the one of the printed book
+	if variant.variantType == "default" && product.isbn != "" {
+		if isbn := normalizeISBN13(product.isbn); isbn != "" {
+			onix.ProductIdentifiers = append(onix.ProductIdentifiers, onixProductID{ProductIDType: "15", IDValue: isbn})
+		} else {
+			color.Yellow("Invalid ISBN-13 left out of ONIX: " + product.article + " " + product.isbn)
+		}
+	}
+
+	if variant.variantType == "default" {
+		dimensionUnit := envOrDefault("ONIX_DIMENSION_UNIT", "mm")
+		for _, measure := range []struct{ key, measureType, unit string }{
+			{"height", "01", dimensionUnit},
+			{"width", "02", dimensionUnit},
+			{"depth", "03", dimensionUnit},
+			{"weight", "08", envOrDefault("ONIX_WEIGHT_UNIT", "gr")},
+		} {
+			value := strings.Replace(strings.TrimSpace(product.dimensions[measure.key]), ",", ".", 1)
+			if _, err := strconv.ParseFloat(value, 64); err == nil {
+				onix.DescriptiveDetail.Measures = append(onix.DescriptiveDetail.Measures, onixMeasure{MeasureType: measure.measureType, Measurement: value, MeasureUnitCode: measure.unit})
+			}
+		}
+		if _, err := strconv.Atoi(product.pages); err == nil {
+			onix.DescriptiveDetail.Extents = append(onix.DescriptiveDetail.Extents, onixExtent{ExtentType: "00", ExtentValue: product.pages, ExtentUnit: "03"})
+		}
+	}
+
+	// ONIX list 17: author, compiler, editor, translator
+	for _, contributors := range []struct {
+		role  string
+		names []string
+	}{
+		{"A01", product.authors},
+		{"C01", product.compilers},
+		{"B01", product.editors},
+		{"B06", product.translators},
+	} {
+		for _, name := range contributors.names {
+			onix.DescriptiveDetail.Contributors = append(onix.DescriptiveDetail.Contributors, onixContributor{
+				SequenceNumber:  len(onix.DescriptiveDetail.Contributors) + 1,
+				ContributorRole: contributors.role,
+				PersonName:      name,
+			})
+		}
+	}
+
+	if product.description != "" {
+		onix.CollateralDetail = &onixCollateralDetail{TextType: "03", ContentAudience: "00", Text: product.description}
+	}
+	if product.publisher != "" || !product.publishDate.IsZero() {
+		onix.PublishingDetail = &onixPublishingDetail{}
+		if product.publisher != "" {
+			onix.PublishingDetail.Publisher = &onixPublisher{PublishingRole: "01", PublisherName: product.publisher}
+		}
+		if !product.publishDate.IsZero() {
+			onix.PublishingDetail.PublishingDateRole = "01"
+			onix.PublishingDetail.PublishingDate = product.publishDate.Format("20060102")
+		}
+	}
+
+	availability := "20"
+	if variant.hidden {
+		availability = "40"
+	}
+	onix.ProductSupply = &onixProductSupply{
+		SupplierRole:        "01",
+		SupplierName:        envOrDefault("ONIX_SENDER", product.publisher),
+		ProductAvailability: availability,
+		// RRP including tax
+		Prices: []onixPrice{{PriceType: "02", PriceAmount: formatPrice(variant.price), CurrencyCode: "RUB"}},
+	}
+	return onix
+}
+
+// checkONIXProduct lists what the schema requires but a product lacks.
+func checkONIXProduct(product onixProduct) []string {
+	problems := make([]string, 0)
+	if product.DescriptiveDetail.TitleDetail.TitleText == "" {
+		problems = append(problems, product.RecordReference+": empty title")
+	}
+	if product.ProductSupply != nil && product.ProductSupply.SupplierName == "" {
+		problems = append(problems, product.RecordReference+": no supplier, set ONIX_SENDER")
+	}
+	return problems
+}
+
+// _skipONIXValidation exports ONIX messages without validating them.
+var _skipONIXValidation bool
+
+// validateONIX validates the message against the XSD in ONIX_XSD with
+// xmllint, refusing to export what it cannot check unless validation is
+// skipped.
+func validateONIX(message []byte) {
+	if _skipONIXValidation {
+		color.Yellow("ONIX schema validation is skipped, the message may be rejected")
+		return
+	}
+	schema, _ := os.LookupEnv("ONIX_XSD")
+	if schema == "" {
+		panic("ONIX_XSD is not set, cannot validate the ONIX message; set it or pass --no-validate")
+	}
+	if _, err := exec.LookPath("xmllint"); err != nil {
+		panic("xmllint is not installed, cannot validate the ONIX message; install it or pass --no-validate")
+	}
+	file, err := ioutil.TempFile("", "1csync-onix-*.xml")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(file.Name())
+	file.Write(message)
+	file.Close()
+	output, err := exec.Command("xmllint", "--noout", "--schema", schema, file.Name()).CombinedOutput()
+	if err != nil {
+		panic("ONIX message does not validate against " + schema + ":\n" + string(output))
+	}
+}
+
+// exportONIX writes an ONIX 3.0 message with one product per priced variant.
+func exportONIX(writer io.Writer) {
+	products, _ := collectCatalog()
+	message := onixMessage{
+		Release: "3.0",
+		Xmlns:   "http://ns.editeur.org/onix/3.0/reference",
+		Header: onixHeader{
+			SenderName:   envOrDefault("ONIX_SENDER", ""),
+			SentDateTime: time.Now().Format("20060102T1504-0700"),
+		},
+	}
+	problems := make([]string, 0)
+	if message.Header.SenderName == "" {
+		problems = append(problems, "ONIX_SENDER is not set")
+	}
+	for _, product := range products {
+		for _, variant := range product.variants {
+			if variant.price <= 0 {
+				continue
+			}
+			onix := newONIXProduct(product, variant)
+			problems = append(problems, checkONIXProduct(onix)...)
+			message.Products = append(message.Products, onix)
+		}
+	}
+	if len(problems) > 0 {
+		panic("ONIX message is invalid:\n" + strings.Join(problems, "\n"))
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buffer)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(message); err != nil {
+		panic(err)
+	}
+	buffer.WriteString("\n")
+	validateONIX(buffer.Bytes())
+	if _, err := writer.Write(buffer.Bytes()); err != nil {
+		panic(err)
+	}
+	logVerbose(fmt.Sprintf("Exported %d ONIX products", len(message.Products)))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// _dryRun makes syliusRequest record every write instead of sending it.
+var _dryRun bool
+
+// plannedChange is a Sylius write request a dry run would have sent.
+type plannedChange struct {
+	Method string                 `json:"method"`
+	URL    string                 `json:"url"`
+	Body   map[string]interface{} `json:"body,omitempty"`
+}
+
+var _plannedChanges []plannedChange
+
+func planChange(requestType string, url string, body io.Reader) {
+	change := plannedChange{Method: requestType, URL: url}
+	if body != nil {
+		content, _ := ioutil.ReadAll(body)
+		json.Unmarshal(content, &change.Body)
+	}
+	_plannedChanges = append(_plannedChanges, change)
+	logVerbose("Planned: " + requestType + " " + url)
+}
+
+func printPlan() {
+	if _outputFormat == outputJSON {
+		body, _ := json.MarshalIndent(_plannedChanges, "", "  ")
+		fmt.Println(string(body))
+		return
+	}
+	counts := make(map[string]int)
+	for _, change := range _plannedChanges {
+		fmt.Println(change.Method, change.URL)
+		counts[change.Method]++
+	}
+	fmt.Printf("Plan: %d POST, %d PATCH, %d DELETE\n", counts["POST"], counts["PATCH"], counts["DELETE"])
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+)
+
+// propertiesCollection is ПланВидовХарактеристик_ДополнительныеРеквизитыИСведения,
+// the definitions of the additional properties.
+const propertiesCollection = "ChartOfCharacteristicTypes_ДополнительныеРеквизитыИСведения"
+
+// propertyDefinition is an additional property as defined in 1C.
+type propertyDefinition struct {
+	key   string
+	name  string
+	title string
+	// types is the declared ТипЗначения
+	types []string
+}
+
+// declaredTypes reads ТипЗначения, which the OData service sends as a type
+// name, a list of them or an object holding the list in Types.
+func declaredTypes(value interface{}) []string {
+	types := make([]string, 0)
+	switch value := value.(type) {
+	case string:
+		if value != "" {
+			types = append(types, strings.TrimPrefix(value, "StandardODATA."))
+		}
+	case []interface{}:
+		for _, item := range value {
+			types = append(types, declaredTypes(item)...)
+		}
+	case map[string]interface{}:
+		types = append(types, declaredTypes(value["Types"])...)
+	}
+	return types
+}
+
+func fetchPropertyDefinitions() []propertyDefinition {
+	definitions := make([]propertyDefinition, 0)
+	for _, definitionRaw := range odataValues(odinCRequest("GET", collectionURL(propertiesCollection), nil)) {
+		decoder := &odataDecoder{name: "property", item: definitionRaw}
+		definition := propertyDefinition{
+			key:   decoder.string("Ref_Key"),
+			name:  decoder.string("Description"),
+			title: decoder.string("Заголовок"),
+			types: declaredTypes(definitionRaw["ТипЗначения"]),
+		}
+		if decoder.err != nil {
+			color.Yellow("Skipping property: " + decoder.err.Error())
+			continue
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions
+}
+
+// _propertyKeysResolved tells that the PROPERTY_ settings were resolved,
+// _propertyKeysErr why they could not be.
+var _propertyKeysResolved bool
+
+var _propertyKeysErr error
+
+// applyPropertyKeys resolves the PROPERTY_ settings once per process and
+// returns the outcome.
+func applyPropertyKeys() error {
+	if !_propertyKeysResolved {
+		_propertyKeysErr = resolvePropertyKeys()
+		_propertyKeysResolved = true
+	}
+	return _propertyKeysErr
+}
+
+// resolvePropertyKeys applies the PROPERTY_<NAME> settings, such as
+// PROPERTY_ISBN or PROPERTY_COVER_TYPE, and PROPERTY_AUTHORS, a
+// comma-separated list. A setting is either a Свойство_Key or the name of
+// the property in 1C, matched against its Description and Заголовок, so the
+// same config works with databases where the keys differ.
+func resolvePropertyKeys() error {
+	settings := make(map[string]string)
+	for name := range propertyKeys {
+		if value := strings.TrimSpace(envOrDefault("PROPERTY_"+strings.ToUpper(name), "")); value != "" {
+			settings[name] = value
+		}
+	}
+	authors := strings.TrimSpace(envOrDefault("PROPERTY_AUTHORS", ""))
+	if len(settings) == 0 && authors == "" {
+		return nil
+	}
+
+	var definitions []propertyDefinition
+	problems := make([]string, 0)
+	resolve := func(setting string, value string) string {
+		if guidPattern.MatchString(value) {
+			return value
+		}
+		// the definitions are only read when a name is configured
+		if definitions == nil {
+			definitions = fetchPropertyDefinitions()
+		}
+		matches := make([]string, 0)
+		for _, definition := range definitions {
+			if strings.EqualFold(definition.name, value) || strings.EqualFold(definition.title, value) {
+				matches = append(matches, definition.key)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			problems = append(problems, fmt.Sprintf("%s: no 1C property named %q", setting, value))
+		case 1:
+			logVerbose(setting + ": " + value + " is " + matches[0])
+			return matches[0]
+		default:
+			problems = append(problems, fmt.Sprintf("%s: %q is ambiguous, matches %s", setting, value, strings.Join(matches, ", ")))
+		}
+		return ""
+	}
+
+	resolved := make(map[string]string)
+	for name, value := range settings {
+		resolved[name] = resolve("PROPERTY_"+strings.ToUpper(name), value)
+	}
+	authorKeys := make([]string, 0)
+	if authors != "" {
+		for _, value := range strings.Split(authors, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				authorKeys = append(authorKeys, resolve("PROPERTY_AUTHORS", value))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	for name, key := range resolved {
+		propertyKeys[name] = key
+	}
+	if authors != "" {
+		authorProperties = authorKeys
+	}
+	return nil
+}
+
+// inspectedProperty is an additional property as `1csync inspect
+// properties` shows it.
+type inspectedProperty struct {
+	Key   string `json:"key"`
+	Name  string `json:"name"`
+	Title string `json:"title,omitempty"`
+	// Types are the declared value types, or the Значение_Type values met
+	// in the Номенклатура items when 1C does not publish the declaration
+	Types []string `json:"types"`
+	// Items is only counted on request, it reads the whole catalog
+	Items  *int   `json:"items,omitempty"`
+	Mapped string `json:"mapped,omitempty"`
+}
+
+// mappedProperties returns what the sync reads each mapped property as.
+func mappedProperties() map[string]string {
+	mapped := make(map[string]string)
+	for index, key := range authorProperties {
+		mapped[key] = "author" + strconv.Itoa(index+1)
+	}
+	for name, key := range propertyKeys {
+		mapped[key] = name
+	}
+	return mapped
+}
+
+// runInspectProperties lists the additional properties of 1C with their
+// value types and, with countItems, the number of Номенклатура items using
+// them.
+func runInspectProperties(countItems bool) ([]inspectedProperty, []string) {
+	mapped := mappedProperties()
+	properties := make([]inspectedProperty, 0)
+	found := make(map[string]int)
+	declared := make(map[string]bool)
+	for _, definition := range fetchPropertyDefinitions() {
+		found[definition.key] = len(properties)
+		declared[definition.key] = len(definition.types) > 0
+		properties = append(properties, inspectedProperty{
+			Key:    definition.key,
+			Name:   definition.name,
+			Title:  definition.title,
+			Types:  definition.types,
+			Mapped: mapped[definition.key],
+		})
+	}
+
+	if countItems {
+		for index := range properties {
+			properties[index].Items = new(int)
+		}
+		for _, itemRaw := range odataValues(odinCRequest("GET", nomenclatureURL, nil)) {
+			item := decodeNomenclatureItem(itemRaw)
+			counted := make(map[string]bool)
+			for _, value := range item.properties {
+				index, ok := found[value.key]
+				if !ok {
+					continue
+				}
+				property := &properties[index]
+				if !counted[value.key] {
+					counted[value.key] = true
+					*property.Items++
+				}
+				valueType := strings.TrimPrefix(value.valueType, "StandardODATA.")
+				if !declared[value.key] && valueType != "" && !containsString(property.Types, valueType) {
+					property.Types = append(property.Types, valueType)
+				}
+			}
+		}
+	}
+
+	missing := make([]string, 0)
+	for key, name := range mapped {
+		if _, ok := found[key]; !ok {
+			missing = append(missing, name+" ("+key+")")
+		}
+	}
+	sort.Strings(missing)
+	sort.SliceStable(properties, func(i, j int) bool {
+		return properties[i].Name < properties[j].Name
+	})
+	return properties, missing
+}
+
+func printInspectProperties(properties []inspectedProperty, missing []string) {
+	if _outputFormat == outputJSON {
+		body, _ := json.MarshalIndent(map[string]interface{}{
+			"properties": properties,
+			"missing":    missing,
+		}, "", "  ")
+		fmt.Println(string(body))
+		return
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "KEY\tNAME\tTYPES\tITEMS\tMAPPED")
+	for _, property := range properties {
+		name := property.Name
+		if property.Title != "" && property.Title != name {
+			name += " (" + property.Title + ")"
+		}
+		types := strings.Join(property.Types, ", ")
+		if types == "" {
+			types = "-"
+		}
+		items := "-"
+		if property.Items != nil {
+			items = strconv.Itoa(*property.Items)
+		}
+		mapped := property.Mapped
+		if mapped == "" {
+			mapped = "unused"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", property.Key, name, types, items, mapped)
+	}
+	writer.Flush()
+	for _, name := range missing {
+		color.Red("Mapped property missing in 1C: " + name)
+	}
+}
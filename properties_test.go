@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolvePropertyKeys(t *testing.T) {
+	definitions := []interface{}{
+		map[string]interface{}{"Ref_Key": "11111111-1111-1111-1111-111111111111", "Description": "ISBN"},
+		map[string]interface{}{"Ref_Key": "22222222-2222-2222-2222-222222222222", "Description": "Автор", "Заголовок": "Автор"},
+		map[string]interface{}{"Ref_Key": "33333333-3333-3333-3333-333333333333", "Description": "Количество страниц"},
+		map[string]interface{}{"Ref_Key": "44444444-4444-4444-4444-444444444444", "Description": "Страницы", "Заголовок": "Количество страниц"},
+	}
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantKeys    map[string]string
+		wantAuthors []string
+		wantErr     []string
+	}{
+		{
+			name:     "name",
+			env:      map[string]string{"PROPERTY_ISBN": "isbn"},
+			wantKeys: map[string]string{"isbn": "11111111-1111-1111-1111-111111111111"},
+		},
+		{
+			name:     "key",
+			env:      map[string]string{"PROPERTY_PAGES": "55555555-5555-5555-5555-555555555555"},
+			wantKeys: map[string]string{"pages": "55555555-5555-5555-5555-555555555555"},
+		},
+		{
+			name:        "authors",
+			env:         map[string]string{"PROPERTY_AUTHORS": "Автор, 55555555-5555-5555-5555-555555555555"},
+			wantAuthors: []string{"22222222-2222-2222-2222-222222222222", "55555555-5555-5555-5555-555555555555"},
+		},
+		{
+			name:    "ambiguous",
+			env:     map[string]string{"PROPERTY_PAGES": "Количество страниц"},
+			wantErr: []string{`PROPERTY_PAGES: "Количество страниц" is ambiguous`},
+		},
+		{
+			name:    "missing",
+			env:     map[string]string{"PROPERTY_SIZE": "Формат", "PROPERTY_AUTHORS": "Автор,Редактор"},
+			wantErr: []string{`PROPERTY_AUTHORS: no 1C property named "Редактор"`, `PROPERTY_SIZE: no 1C property named "Формат"`},
+		},
+	}
+
+	savedKeys := make(map[string]string)
+	for name, key := range propertyKeys {
+		savedKeys[name] = key
+	}
+	savedAuthors := authorProperties
+	savedSource := _source
+	defer func() {
+		propertyKeys = savedKeys
+		authorProperties = savedAuthors
+		_source = savedSource
+	}()
+	_source = &offlineSource{name: "test", collections: map[string][]interface{}{propertiesCollection: definitions}}
+
+	for _, test := range tests {
+		propertyKeys = make(map[string]string)
+		for name, key := range savedKeys {
+			propertyKeys[name] = key
+		}
+		authorProperties = savedAuthors
+		for name := range savedKeys {
+			t.Setenv("PROPERTY_"+strings.ToUpper(name), test.env["PROPERTY_"+strings.ToUpper(name)])
+		}
+		t.Setenv("PROPERTY_AUTHORS", test.env["PROPERTY_AUTHORS"])
+
+		err := resolvePropertyKeys()
+		if len(test.wantErr) > 0 {
+			if err == nil {
+				t.Errorf("%s: no error, want %v", test.name, test.wantErr)
+				continue
+			}
+			for _, want := range test.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("%s: error %q does not mention %q", test.name, err, want)
+				}
+			}
+			for name, key := range savedKeys {
+				if propertyKeys[name] != key {
+					t.Errorf("%s: %s changed to %s despite the error", test.name, name, propertyKeys[name])
+				}
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for name, want := range test.wantKeys {
+			if propertyKeys[name] != want {
+				t.Errorf("%s: %s = %s, want %s", test.name, name, propertyKeys[name], want)
+			}
+		}
+		if test.wantAuthors != nil && strings.Join(authorProperties, ",") != strings.Join(test.wantAuthors, ",") {
+			t.Errorf("%s: authors = %v, want %v", test.name, authorProperties, test.wantAuthors)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting requests per second combined with a
+// semaphore limiting the number of requests in flight against one backend.
+type rateLimiter struct {
+	name     string
+	rps      float64
+	burst    float64
+	inFlight chan struct{}
+
+	mutex    sync.Mutex
+	tokens   float64
+	last     time.Time
+	requests int
+	waited   time.Duration
+	started  time.Time
+}
+
+func newRateLimiter(name string, rps float64, maxInFlight int) *rateLimiter {
+	limiter := &rateLimiter{
+		name:    name,
+		rps:     rps,
+		burst:   1,
+		started: time.Now(),
+	}
+	if rps > 1 {
+		limiter.burst = rps
+	}
+	limiter.tokens = limiter.burst
+	limiter.last = limiter.started
+	if maxInFlight > 0 {
+		limiter.inFlight = make(chan struct{}, maxInFlight)
+	}
+	return limiter
+}
+
+// rateLimiterFromEnv reads <prefix>_RPS and <prefix>_MAX_IN_FLIGHT.
+// Zero or missing values mean no limit.
+func rateLimiterFromEnv(name string, prefix string) *rateLimiter {
+	rps := 0.0
+	if value, ok := os.LookupEnv(prefix + "_RPS"); ok && value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			panic("Invalid " + prefix + "_RPS: " + value)
+		}
+		rps = parsed
+	}
+	maxInFlight := 0
+	if value, ok := os.LookupEnv(prefix + "_MAX_IN_FLIGHT"); ok && value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			panic("Invalid " + prefix + "_MAX_IN_FLIGHT: " + value)
+		}
+		maxInFlight = parsed
+	}
+	return newRateLimiter(name, rps, maxInFlight)
+}
+
+// acquire blocks until a request may be sent; every acquire must be followed
+// by a release once the response has been read.
+func (limiter *rateLimiter) acquire() {
+	if limiter.inFlight != nil {
+		limiter.inFlight <- struct{}{}
+	}
+	limiter.mutex.Lock()
+	limiter.requests++
+	if limiter.rps <= 0 {
+		limiter.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rps
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+	limiter.last = now
+	limiter.tokens--
+	var wait time.Duration
+	if limiter.tokens < 0 {
+		wait = time.Duration(-limiter.tokens / limiter.rps * float64(time.Second))
+		limiter.waited += wait
+	}
+	limiter.mutex.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (limiter *rateLimiter) release() {
+	if limiter.inFlight != nil {
+		<-limiter.inFlight
+	}
+}
+
+func (limiter *rateLimiter) summary() string {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	elapsed := time.Since(limiter.started).Seconds()
+	throughput := 0.0
+	if elapsed > 0 {
+		throughput = float64(limiter.requests) / elapsed
+	}
+	return fmt.Sprintf("%s: %d requests, %.2f req/s, %s spent waiting for rate limit", limiter.name, limiter.requests, throughput, limiter.waited.Round(time.Millisecond))
+}
+
+// resetStats restarts the counters reported by summary, e.g. between runs
+// of a long-lived process.
+func (limiter *rateLimiter) resetStats() {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.requests = 0
+	limiter.waited = 0
+	limiter.started = time.Now()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// _force skips the safety thresholds of the disable and prune phases.
+var _force bool
+
+func thresholdFromEnv(name string, defaultValue float64) float64 {
+	value := envOrDefault(name, "")
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		panic("Invalid " + name + ": " + value)
+	}
+	return parsed
+}
+
+// checkRemovalThreshold refuses removing more than DISABLE_MAX_COUNT items
+// or DISABLE_MAX_PERCENT percent of them at once: an empty or truncated
+// answer from 1C must not empty the shop. Zero turns a limit off.
+func checkRemovalThreshold(what string, affected int, total int) error {
+	if _force || affected == 0 {
+		return nil
+	}
+	maxCount := thresholdFromEnv("DISABLE_MAX_COUNT", 50)
+	if maxCount > 0 && float64(affected) > maxCount {
+		return fmt.Errorf("%d %s would be removed, more than DISABLE_MAX_COUNT=%g", affected, what, maxCount)
+	}
+	maxPercent := thresholdFromEnv("DISABLE_MAX_PERCENT", 10)
+	if maxPercent > 0 && total > 0 && float64(affected)*100/float64(total) > maxPercent {
+		return fmt.Errorf("%d of %d %s would be removed, more than DISABLE_MAX_PERCENT=%g%%", affected, total, what, maxPercent)
+	}
+	return nil
+}
+
+// missingProducts lists the existing Sylius products that are not present in 1C.
+func missingProducts(existing []existingProduct, present []string) []existingProduct {
+	missing := make([]existingProduct, 0)
+	for _, product := range existing {
+		if !containsString(present, product.code) {
+			missing = append(missing, product)
+		}
+	}
+	return missing
+}
+
+// countEnabled counts the enabled products among slugs.
+func countEnabled(existing []existingProduct, slugs []string) int {
+	count := 0
+	for _, product := range existing {
+		if product.enabled && containsString(slugs, product.code) {
+			count++
+		}
+	}
+	return count
+}
+
+func durationFromEnv(name string) time.Duration {
+	value := envOrDefault(name, "")
+	if value == "" {
+		return 0
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		panic("Invalid " + name + ": " + value)
+	}
+	return parsed
+}
+
+// trackMissingProducts counts for how many consecutive runs and since when
+// each product has been missing from 1C, and returns the products to
+// disable and to delete: disabled after DISABLE_GRACE_RUNS runs and
+// DISABLE_GRACE_PERIOD, deleted once missing for DELETE_AFTER. Products
+// disabled already are only tracked while they wait for DELETE_AFTER.
+func trackMissingProducts(missing []existingProduct) (toDisable []string, toDelete []string) {
+	graceRuns := int(thresholdFromEnv("DISABLE_GRACE_RUNS", 0))
+	gracePeriod := durationFromEnv("DISABLE_GRACE_PERIOD")
+	deleteAfter := durationFromEnv("DELETE_AFTER")
+	now := time.Now()
+
+	missingSlugs := make(map[string]bool)
+	for _, product := range missing {
+		missingSlugs[product.code] = true
+	}
+	for slug := range _state.Missing {
+		if !missingSlugs[slug] {
+			delete(_state.Missing, slug)
+		}
+	}
+	toDisable = make([]string, 0)
+	toDelete = make([]string, 0)
+	for _, product := range missing {
+		slug := product.code
+		if !product.enabled && deleteAfter <= 0 {
+			delete(_state.Missing, slug)
+			continue
+		}
+		entry, ok := _state.Missing[slug]
+		if !ok {
+			entry = missingProduct{Since: now}
+		}
+		entry.Runs++
+		_state.Missing[slug] = entry
+		missingFor := now.Sub(entry.Since)
+		if deleteAfter > 0 && missingFor >= deleteAfter {
+			toDelete = append(toDelete, slug)
+		} else if !product.enabled {
+			logVerbose("Missing from 1C, disabled until DELETE_AFTER: " + slug)
+		} else if entry.Runs > graceRuns && missingFor >= gracePeriod {
+			toDisable = append(toDisable, slug)
+		} else {
+			logVerbose("Missing from 1C, within grace period: " + slug)
+		}
+	}
+	return toDisable, toDelete
+}
+
+// guardedPrune removes the products marked for deletion in 1C, disables or
+// deletes the products missing from 1C for longer than the grace period and
+// prunes authors, publishers and categories, unless too many products would
+// be removed. Every enabled product missing from 1C counts against the
+// thresholds, within its grace period or not: an empty or truncated answer
+// from 1C must stop the taxon pruning as well. Products disabled already
+// are out of the shop and do not count.
+func guardedPrune(existing []existingProduct, present []string, report *runReport) {
+	// products marked for deletion in 1C are removed without a grace period,
+	// unless an earlier run did it already
+	marked := make([]string, 0)
+	enabled := 0
+	for _, product := range existing {
+		if !product.enabled {
+			continue
+		}
+		enabled++
+		if containsString(_deletionMarkedProducts, product.code) {
+			marked = append(marked, product.code)
+		}
+	}
+	missing := missingProducts(existing, append(append([]string{}, present...), _deletionMarkedProducts...))
+	missingSlugs := make([]string, 0)
+	for _, product := range missing {
+		missingSlugs = append(missingSlugs, product.code)
+	}
+	missingEnabled := countEnabled(existing, missingSlugs)
+	toDisable, toDelete := trackMissingProducts(missing)
+	if err := checkRemovalThreshold("products", missingEnabled+len(marked), enabled); err != nil {
+		reason := "disable and prune skipped: " + err.Error() + ", use --force to override"
+		trackProgress(func() { report.SafetyAbort = reason })
+		return
+	}
+	removeDeletionMarkedProducts(marked, report)
+	disableMissingProducts(toDisable, report)
+	deleteMissingProducts(toDelete, report)
+	// products within the grace period stay in the shop but were not
+	// imported, so their authors and publishers are not marked in use
+	if waiting := missingEnabled - len(toDisable) - countEnabled(existing, toDelete); waiting > 0 {
+		color.Yellow(fmt.Sprintf("%d products missing from 1C are within the grace period, authors and publishers are not pruned", waiting))
+	} else {
+		pruneAuthors()
+		pruneManufacturers()
+	}
+	pruneCategories(report)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckRemovalThreshold(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxCount   string
+		maxPercent string
+		force      bool
+		affected   int
+		total      int
+		wantErr    bool
+	}{
+		{"nothing to remove", "", "", false, 0, 0, false},
+		{"within the defaults", "", "", false, 5, 100, false},
+		{"over the default count", "", "", false, 51, 10000, true},
+		{"over the default percent", "", "", false, 11, 100, true},
+		{"at the limits", "", "", false, 10, 100, false},
+		{"count limit off", "0", "", false, 500, 10000, false},
+		{"percent limit off", "", "0", false, 40, 100, false},
+		{"empty total", "", "", false, 5, 0, false},
+		{"forced", "", "", true, 1000, 1000, false},
+	}
+	for _, test := range tests {
+		t.Setenv("DISABLE_MAX_COUNT", test.maxCount)
+		t.Setenv("DISABLE_MAX_PERCENT", test.maxPercent)
+		_force = test.force
+		err := checkRemovalThreshold("products", test.affected, test.total)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: checkRemovalThreshold(%d, %d) = %v, want error %v", test.name, test.affected, test.total, err, test.wantErr)
+		}
+	}
+	_force = false
+}
+
+func TestMissingProductsCountsEnabled(t *testing.T) {
+	existing := []existingProduct{
+		{code: "ethics-10", enabled: true},
+		{code: "logic-2", enabled: true},
+		{code: "gone-1", enabled: true},
+		{code: "gone-2", enabled: false},
+	}
+	missing := missingProducts(existing, []string{"ethics-10", "logic-2"})
+	if len(missing) != 2 || missing[0].code != "gone-1" || missing[1].code != "gone-2" {
+		t.Fatalf("missingProducts = %v, want gone-1 and gone-2", missing)
+	}
+	if got := countEnabled(existing, []string{"gone-1", "gone-2"}); got != 1 {
+		t.Errorf("countEnabled = %d, want 1, disabled products do not count", got)
+	}
+}
+
+func TestTrackMissingProducts(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		graceRuns   string
+		deleteAfter string
+		enabled     bool
+		saved       *missingProduct
+		wantDisable bool
+		wantDelete  bool
+		wantTracked bool
+	}{
+		{"disabled without grace", "", "", true, nil, true, false, true},
+		{"first run within grace runs", "1", "", true, nil, false, false, true},
+		{"past the grace runs", "1", "", true, &missingProduct{Since: now, Runs: 1}, true, false, true},
+		{"past DELETE_AFTER", "", "24h", true, &missingProduct{Since: now.Add(-48 * time.Hour), Runs: 5}, false, true, true},
+		{"disabled already", "", "", false, &missingProduct{Since: now, Runs: 3}, false, false, false},
+		{"disabled, waiting for DELETE_AFTER", "", "24h", false, &missingProduct{Since: now, Runs: 3}, false, false, true},
+		{"disabled, past DELETE_AFTER", "", "24h", false, &missingProduct{Since: now.Add(-48 * time.Hour), Runs: 3}, false, true, true},
+	}
+	for _, test := range tests {
+		t.Setenv("DISABLE_GRACE_RUNS", test.graceRuns)
+		t.Setenv("DISABLE_GRACE_PERIOD", "")
+		t.Setenv("DELETE_AFTER", test.deleteAfter)
+		_state = &syncState{Missing: map[string]missingProduct{
+			// no longer missing, so no longer tracked
+			"back-1": {Since: now, Runs: 2},
+		}}
+		if test.saved != nil {
+			_state.Missing["gone-1"] = *test.saved
+		}
+		toDisable, toDelete := trackMissingProducts([]existingProduct{{code: "gone-1", enabled: test.enabled}})
+		if got := len(toDisable) == 1; got != test.wantDisable {
+			t.Errorf("%s: toDisable = %v, want disabling %v", test.name, toDisable, test.wantDisable)
+		}
+		if got := len(toDelete) == 1; got != test.wantDelete {
+			t.Errorf("%s: toDelete = %v, want deleting %v", test.name, toDelete, test.wantDelete)
+		}
+		if _, got := _state.Missing["gone-1"]; got != test.wantTracked {
+			t.Errorf("%s: tracked = %v, want %v", test.name, got, test.wantTracked)
+		}
+		if _, ok := _state.Missing["back-1"]; ok {
+			t.Errorf("%s: a product back in 1C is still tracked", test.name)
+		}
+	}
+}
+
+func TestGuardedPruneCountsProductsWithinGrace(t *testing.T) {
+	t.Setenv("DISABLE_GRACE_RUNS", "3")
+	t.Setenv("DISABLE_GRACE_PERIOD", "")
+	t.Setenv("DELETE_AFTER", "")
+	t.Setenv("DISABLE_MAX_COUNT", "")
+	t.Setenv("DISABLE_MAX_PERCENT", "")
+	_state = &syncState{Missing: make(map[string]missingProduct)}
+	_deletionMarkedProducts = make([]string, 0)
+	existing := make([]existingProduct, 0)
+	for _, code := range []string{"ethics-10", "logic-2", "rhetoric-1", "poetics-4"} {
+		existing = append(existing, existingProduct{code: code, enabled: true})
+	}
+	// 1C answered with no products at all: nothing is due for disabling
+	// yet, but nothing may be pruned either
+	report := &runReport{}
+	guardedPrune(existing, []string{}, report)
+	if report.SafetyAbort == "" {
+		t.Error("an empty 1C answer passed the thresholds")
+	}
+	if len(_state.Missing) != 4 {
+		t.Errorf("tracked %d missing products, want 4", len(_state.Missing))
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// serveStatus is what the status endpoint reports about the daemon.
+type serveStatus struct {
+	Running *runReport `json:"running,omitempty"`
+	LastRun *runReport `json:"lastRun,omitempty"`
+	// NextFull and NextIncremental are nil when the schedule is disabled
+	NextFull        *time.Time `json:"nextFull,omitempty"`
+	NextIncremental *time.Time `json:"nextIncremental,omitempty"`
+}
+
+var _status serveStatus
+
+var _statusMutex sync.Mutex
+
+func envOrDefault(name string, defaultValue string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return defaultValue
+}
+
+// scheduleFromEnv returns nil when the schedule is disabled with an empty value.
+func scheduleFromEnv(name string, defaultValue string) *cronSchedule {
+	expression := envOrDefault(name, defaultValue)
+	if expression == "" {
+		return nil
+	}
+	schedule, err := parseCronSchedule(expression)
+	if err != nil {
+		panic("Invalid " + name + ": " + err.Error())
+	}
+	return schedule
+}
+
+// _runMutex serialises runs: the sync state lives in globals.
+var _runMutex sync.Mutex
+
+var _runHistory []*runReport
+
+// _runHistorySize is RUN_HISTORY_SIZE, read when serve starts.
+var _runHistorySize = 50
+
+func runHistorySizeFromEnv() int {
+	historySize, err := strconv.Atoi(envOrDefault("RUN_HISTORY_SIZE", "50"))
+	if err != nil || historySize < 1 {
+		panic("Invalid RUN_HISTORY_SIZE: " + envOrDefault("RUN_HISTORY_SIZE", ""))
+	}
+	return historySize
+}
+
+// executeRun records the report of a run in the status and the run
+// history, keeping the daemon alive if the run panics. The caller must
+// hold _runMutex.
+func executeRun(mode string, run func() *runReport) {
+	started := time.Now()
+	report := func() (report *runReport) {
+		defer func() {
+			if r := recover(); r != nil {
+				report = &runReport{Mode: mode, Started: started, Finished: time.Now(), Error: fmt.Sprint(r)}
+			}
+		}()
+		return run()
+	}()
+	printRunReport(report)
+
+	trackProgress(func() {
+		_status.Running = nil
+		_status.LastRun = report
+		_runHistory = append(_runHistory, report)
+		if len(_runHistory) > _runHistorySize {
+			_runHistory = _runHistory[len(_runHistory)-_runHistorySize:]
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	_statusMutex.Lock()
+	body, _ := json.Marshal(value)
+	_statusMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// requireToken protects a handler with the CONTROL_API_TOKEN bearer token.
+// Without a configured token every request is refused.
+func requireToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := os.LookupEnv("CONTROL_API_TOKEN")
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// triggerRun starts a run in the background, or answers 409 if one is
+// already in progress.
+func triggerRun(w http.ResponseWriter, mode string, run func() *runReport) {
+	if !_runMutex.TryLock() {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "a sync is already running"})
+		return
+	}
+	go func() {
+		defer _runMutex.Unlock()
+		executeRun(mode, run)
+	}()
+	writeJSON(w, http.StatusAccepted, map[string]string{"mode": mode})
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &_status)
+}
+
+func handleProgress(w http.ResponseWriter, r *http.Request) {
+	_statusMutex.Lock()
+	running := _status.Running
+	_statusMutex.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"running": running})
+}
+
+func handleRuns(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+			return
+		}
+		limit = parsed
+	}
+	_statusMutex.Lock()
+	runs := make([]*runReport, 0)
+	// newest first
+	for i := len(_runHistory) - 1; i >= 0 && len(runs) < limit; i-- {
+		runs = append(runs, _runHistory[i])
+	}
+	_statusMutex.Unlock()
+	writeJSON(w, http.StatusOK, runs)
+}
+
+func handleSync(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+			return
+		}
+		sku := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sync"), "/")
+		if sku == "" {
+			triggerRun(w, syncModeFull, func() *runReport {
+				return runSync(ctx, syncOptions{mode: syncModeFull})
+			})
+			return
+		}
+		triggerRun(w, syncModeSKU, func() *runReport {
+			return syncSKUs(ctx, []string{sku})
+		})
+	}
+}
+
+// serve runs full and incremental syncs on the SYNC_SCHEDULE_FULL and
+// SYNC_SCHEDULE_INCREMENTAL cron expressions until ctx is cancelled. The
+// Sylius token and the 1C reference catalogs stay loaded between runs.
+func serve(ctx context.Context) {
+	// the configuration is checked here, a bad value must not stop the
+	// daemon after its first run
+	_runHistorySize = runHistorySizeFromEnv()
+	fullSchedule := scheduleFromEnv("SYNC_SCHEDULE_FULL", "0 3 * * *")
+	incrementalSchedule := scheduleFromEnv("SYNC_SCHEDULE_INCREMENTAL", "*/15 * * * *")
+	if fullSchedule == nil && incrementalSchedule == nil {
+		panic("Both SYNC_SCHEDULE_FULL and SYNC_SCHEDULE_INCREMENTAL are disabled")
+	}
+
+	if token, _ := os.LookupEnv("CONTROL_API_TOKEN"); token == "" {
+		color.Yellow("CONTROL_API_TOKEN is not set, the control API will refuse all requests")
+	}
+	if secret, _ := os.LookupEnv("WEBHOOK_SECRET"); secret == "" {
+		color.Yellow("WEBHOOK_SECRET is not set, the 1C webhook will refuse all requests")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", requireToken(handleStatus))
+	mux.HandleFunc("/progress", requireToken(handleProgress))
+	mux.HandleFunc("/runs", requireToken(handleRuns))
+	mux.HandleFunc("/sync", requireToken(handleSync(ctx)))
+	mux.HandleFunc("/sync/", requireToken(handleSync(ctx)))
+	// 1C signs its requests instead of sending the bearer token
+	mux.HandleFunc("/webhook/1c", handleWebhook(newWebhookDebouncer(ctx)))
+	server := &http.Server{Addr: envOrDefault("SERVE_ADDR", ":8080"), Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+	defer server.Shutdown(context.Background())
+
+	fmt.Println("Serving 1C and Sylius sync, control API on " + server.Addr)
+	_runMutex.Lock()
+	initApp()
+	refreshReferences()
+	_runMutex.Unlock()
+
+	for {
+		now := time.Now()
+		var nextFull, nextIncremental time.Time
+		_statusMutex.Lock()
+		_status.NextFull, _status.NextIncremental = nil, nil
+		if fullSchedule != nil {
+			nextFull = fullSchedule.next(now)
+			_status.NextFull = &nextFull
+		}
+		if incrementalSchedule != nil {
+			nextIncremental = incrementalSchedule.next(now)
+			_status.NextIncremental = &nextIncremental
+		}
+		_statusMutex.Unlock()
+		mode, next := syncModeFull, nextFull
+		// a full sync due at the same time covers the incremental one
+		if fullSchedule == nil || (incrementalSchedule != nil && nextIncremental.Before(nextFull)) {
+			mode, next = syncModeIncremental, nextIncremental
+		}
+
+		logVerbose("Next " + mode + " sync at " + next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			color.Yellow("Shutting down")
+			// let a run triggered through the API finish its current product
+			_runMutex.Lock()
+			_runMutex.Unlock()
+			return
+		case <-timer.C:
+		}
+		_runMutex.Lock()
+		executeRun(mode, func() *runReport {
+			return runSync(ctx, syncOptions{mode: mode})
+		})
+		_runMutex.Unlock()
+		if ctx.Err() != nil {
+			color.Yellow("Shutting down")
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// snapshotCollections are the collections a snapshot holds, in full: the
+// replay applies the filters of the sync itself.
+var snapshotCollections = []string{
+	pricesCollection,
+	valuesCollection,
+	categoriesCollection,
+	manufacturersCollection,
+	nomenclatureCollection,
+	propertiesCollection,
+}
+
+func collectionURL(collection string) string {
+	return "/odata/standard.odata/" + url.PathEscape(collection) + "/?$format=json"
+}
+
+func snapshotPath(dir string, collection string) string {
+	return filepath.Join(dir, collection+".json")
+}
+
+// runSnapshot saves the OData responses of every collection the sync reads
+// into dir, one <collection>.json each.
+func runSnapshot(dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		panic(err)
+	}
+	for _, collection := range snapshotCollections {
+		response := odinCRequest("GET", collectionURL(collection), nil)
+		if _, ok := response["value"].([]interface{}); !ok {
+			panic("Unexpected 1C response for " + collection)
+		}
+		body, _ := json.MarshalIndent(response, "", "  ")
+		if err := ioutil.WriteFile(snapshotPath(dir, collection), body, 0644); err != nil {
+			panic(err)
+		}
+		logVerbose("Saved " + snapshotPath(dir, collection))
+	}
+}
+
+// loadSnapshot reads a directory written by runSnapshot.
+func loadSnapshot(dir string) *offlineSource {
+	source := &offlineSource{name: "snapshot:" + dir, collections: make(map[string][]interface{})}
+	for _, collection := range snapshotCollections {
+		body, err := ioutil.ReadFile(snapshotPath(dir, collection))
+		// older snapshots have no property definitions
+		if os.IsNotExist(err) && collection == propertiesCollection {
+			continue
+		}
+		if err != nil {
+			panic(err)
+		}
+		var response map[string]interface{}
+		if errJSON := json.Unmarshal(body, &response); errJSON != nil {
+			panic(snapshotPath(dir, collection) + ": " + errJSON.Error())
+		}
+		value, ok := response["value"].([]interface{})
+		if !ok {
+			panic(snapshotPath(dir, collection) + ": no value list")
+		}
+		source.collections[collection] = value
+	}
+	return source
+}
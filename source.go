@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The OData collections the sync reads, by their unescaped names.
+const (
+	pricesCollection        = "InformationRegister_ЦеныНоменклатуры"
+	valuesCollection        = "Catalog_ЗначенияСвойствОбъектов"
+	categoriesCollection    = "Catalog_ЗначенияСвойствОбъектовИерархия"
+	manufacturersCollection = "Catalog_Производители"
+	nomenclatureCollection  = "Catalog_Номенклатура"
+)
+
+// emptyRefKey is the Parent_Key of top-level items.
+const emptyRefKey = "00000000-0000-0000-0000-000000000000"
+
+var odataItemRegexp = regexp.MustCompile(`^(.+)\(guid'([^']+)'\)$`)
+
+var odataTermRegexp = regexp.MustCompile(`^(\S+) (eq|ne) (.+)$`)
+
+var odataStartswithRegexp = regexp.MustCompile(`^startswith\((\S+), (.+)\)$`)
+
+var odataOrderByRegexp = regexp.MustCompile(`^(\S+)(?: (asc|desc))?$`)
+
+// offlineSource answers the OData requests of the sync from collections
+// held in memory instead of the 1C server. It understands the filters the
+// sync uses: eq, ne and startswith joined by or.
+type offlineSource struct {
+	name        string
+	collections map[string][]interface{}
+	// categoryValues holds the categories each property would give; those
+	// of the category property are served once the property keys are
+	// resolved, which needs the source itself
+	categoryValues map[string][]interface{}
+}
+
+// _source replaces the 1C server when --source is not odata.
+var _source *offlineSource
+
+// _sourceSpec is the --source flag: odata, commerceml:<dir> or
+// snapshot:<dir>.
+var _sourceSpec = "odata"
+
+func openSource(spec string) *offlineSource {
+	parts := strings.SplitN(spec, ":", 2)
+	switch {
+	case spec == "" || spec == "odata":
+		return nil
+	case parts[0] == "commerceml" && len(parts) == 2 && parts[1] != "":
+		return loadCommerceML(parts[1])
+	case parts[0] == "snapshot" && len(parts) == 2 && parts[1] != "":
+		return loadSnapshot(parts[1])
+	}
+	panic("Unknown source: " + spec)
+}
+
+// odataLiteral decodes a string, guid or boolean literal of a $filter.
+func odataLiteral(literal string) interface{} {
+	literal = strings.TrimPrefix(literal, "guid")
+	if len(literal) >= 2 && strings.HasPrefix(literal, "'") && strings.HasSuffix(literal, "'") {
+		return strings.ReplaceAll(literal[1:len(literal)-1], "''", "'")
+	}
+	switch literal {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	panic("Unsupported OData literal: " + literal)
+}
+
+func matchesODataFilter(item map[string]interface{}, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	for _, term := range strings.Split(filter, " or ") {
+		term = strings.TrimSpace(term)
+		if match := odataStartswithRegexp.FindStringSubmatch(term); match != nil {
+			value, _ := item[match[1]].(string)
+			prefix, _ := odataLiteral(match[2]).(string)
+			if strings.HasPrefix(value, prefix) {
+				return true
+			}
+			continue
+		}
+		match := odataTermRegexp.FindStringSubmatch(term)
+		if match == nil {
+			panic("Unsupported OData filter: " + filter)
+		}
+		if (item[match[1]] == odataLiteral(match[3])) == (match[2] == "eq") {
+			return true
+		}
+	}
+	return false
+}
+
+// records lists the single records of a register held as record sets, as
+// OData serves them at <register>_RecordType.
+func (source *offlineSource) records(register string) ([]interface{}, bool) {
+	recordSets, ok := source.collections[register]
+	records := make([]interface{}, 0)
+	for _, recordSet := range recordSets {
+		if list, isList := recordSet.(map[string]interface{})["RecordSet"].([]interface{}); isList {
+			records = append(records, list...)
+		}
+	}
+	return records, ok
+}
+
+func (source *offlineSource) get(requestURL string) map[string]interface{} {
+	parsed, err := url.Parse(requestURL)
+	if err != nil {
+		panic(err)
+	}
+	collection := path.Base(parsed.Path)
+	refKey := ""
+	if match := odataItemRegexp.FindStringSubmatch(collection); match != nil {
+		collection, refKey = match[1], match[2]
+	}
+	items, ok := source.collections[collection]
+	if collection == categoriesCollection && source.categoryValues != nil {
+		items, ok = source.categoryValues[propertyKeys["category"]], true
+	}
+	if records := strings.TrimSuffix(collection, "_RecordType"); !ok && records != collection {
+		items, ok = source.records(records)
+	}
+	if !ok {
+		panic("No " + collection + " in the " + source.name + " source")
+	}
+
+	if refKey != "" {
+		for _, itemRaw := range items {
+			if item := itemRaw.(map[string]interface{}); item["Ref_Key"] == refKey {
+				return item
+			}
+		}
+		return map[string]interface{}{"odata.error": map[string]interface{}{"message": "Not found: " + refKey}}
+	}
+
+	query := parsed.Query()
+	value := make([]interface{}, 0)
+	for _, itemRaw := range items {
+		if matchesODataFilter(itemRaw.(map[string]interface{}), query.Get("$filter")) {
+			value = append(value, itemRaw)
+		}
+	}
+	if orderBy := query.Get("$orderby"); orderBy != "" {
+		match := odataOrderByRegexp.FindStringSubmatch(orderBy)
+		if match == nil {
+			panic("Unsupported OData $orderby: " + orderBy)
+		}
+		sort.SliceStable(value, func(i, j int) bool {
+			left, right := value[i].(map[string]interface{})[match[1]], value[j].(map[string]interface{})[match[1]]
+			if match[2] == "desc" {
+				left, right = right, left
+			}
+			// ordering attributes are numbers, the other fields strings
+			if leftNumber, ok := left.(float64); ok {
+				rightNumber, _ := right.(float64)
+				return leftNumber < rightNumber
+			}
+			leftString, _ := left.(string)
+			rightString, _ := right.(string)
+			return leftString < rightString
+		})
+	}
+	if top, err := strconv.Atoi(query.Get("$top")); err == nil && top < len(value) {
+		value = value[:top]
+	}
+	return map[string]interface{}{"value": value}
+}
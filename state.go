@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// variantPrice is the channel pricing last sent to Sylius for a variant.
+type variantPrice struct {
+	Price         float64 `json:"price"`
+	OriginalPrice float64 `json:"originalPrice,omitempty"`
+}
+
+// missingProduct tracks a Sylius product that is no longer in 1C.
+type missingProduct struct {
+	Since time.Time `json:"since"`
+	Runs  int       `json:"runs"`
+}
+
+// syncState is what 1csync remembers about Sylius between runs.
+type syncState struct {
+	Prices  map[string]variantPrice   `json:"prices"`
+	Missing map[string]missingProduct `json:"missing"`
+	// Categories maps the codes of the category taxons created from 1C
+	// to their parent taxon.
+	Categories map[string]string `json:"categories"`
+}
+
+var _state *syncState
+
+func statePath() string {
+	if path, ok := os.LookupEnv("STATE_FILE"); ok && path != "" {
+		return path
+	}
+	return "1csync.state.json"
+}
+
+func loadState() {
+	_state = &syncState{}
+	body, err := ioutil.ReadFile(statePath())
+	if err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+	if err == nil {
+		if errJSON := json.Unmarshal(body, _state); errJSON != nil {
+			panic(errJSON)
+		}
+	}
+	if _state.Prices == nil {
+		_state.Prices = make(map[string]variantPrice)
+	}
+	if _state.Missing == nil {
+		_state.Missing = make(map[string]missingProduct)
+	}
+	if _state.Categories == nil {
+		_state.Categories = make(map[string]string)
+	}
+}
+
+// saveState writes the state through a temporary file, so an interrupted
+// write does not lose it.
+func saveState() {
+	if _dryRun {
+		return
+	}
+	body, _ := json.Marshal(_state)
+	path := statePath()
+	if err := ioutil.WriteFile(path+".tmp", body, 0644); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		panic(err)
+	}
+}
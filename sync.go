@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	syncModeFull        = "full"
+	syncModeIncremental = "incremental"
+	syncModeSKU         = "sku"
+	syncModePrices      = "prices"
+	syncModePrune       = "prune"
+)
+
+// syncOptions controls one run of the products loop.
+type syncOptions struct {
+	mode   string
+	resume bool
+}
+
+// runReport summarises one sync run.
+type runReport struct {
+	Mode             string    `json:"mode"`
+	Started          time.Time `json:"started"`
+	Finished         time.Time `json:"finished"`
+	Products         int       `json:"products"`
+	Processed        int       `json:"processed"`
+	Current          string    `json:"current,omitempty"`
+	Imported         int       `json:"imported"`
+	Unchanged        int       `json:"unchanged"`
+	Failed           int       `json:"failed"`
+	Disabled         int       `json:"disabled"`
+	Deleted          int       `json:"deleted"`
+	PrunedVariants   int       `json:"prunedVariants"`
+	PrunedCategories int       `json:"prunedCategories"`
+	Folders          int       `json:"folders"`
+	DeletionMarked   int       `json:"deletionMarked"`
+	Interrupted      bool      `json:"interrupted"`
+	SafetyAbort      string    `json:"safetyAbort,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	Throughput       []string  `json:"throughput"`
+}
+
+// _syncedVersions keeps the DataVersion/price signature of every product
+// imported by a previous run of this process, for incremental syncs.
+var _syncedVersions = make(map[string]string)
+
+func resetRunState() {
+	_importedAuthors = make(map[string]bool)
+	_importedManufacturers = make(map[string]bool)
+	_prices = make(map[string]priceRecord)
+	_variants = make(map[string][]nomenclatureItem)
+	_staleVariants = make([]staleVariant, 0)
+	_seenVariants = 0
+	_skippedFolders = 0
+	_deletionMarked = 0
+	_deletionMarkedProducts = make([]string, 0)
+	_syliusLimiter.resetStats()
+	_odinCLimiter.resetStats()
+}
+
+// refreshReferences syncs categories and reloads the 1C reference catalogs
+// the products refer to.
+func refreshReferences() {
+	ensureSyliusToken()
+	syncCategories()
+	fetchValues()
+	fetchManufacturers()
+}
+
+// productSignature changes whenever the product, one of its variants or
+// one of their prices is changed in 1C.
+func productSignature(sourceProduct nomenclatureItem) string {
+	items := []nomenclatureItem{sourceProduct}
+	items = append(items, _variants[sourceProduct.article]...)
+	parts := make([]string, 0)
+	for _, item := range items {
+		refKey := item.refKey
+		dataVersion := item.dataVersion
+		if dataVersion == "" {
+			// without a DataVersion every run has to import the product
+			return ""
+		}
+		price := ""
+		if priceItem, ok := _prices[refKey]; ok {
+			price = strconv.FormatFloat(priceItem.price, 'f', -1, 64)
+		}
+		parts = append(parts, refKey+":"+dataVersion+":"+price)
+	}
+	return strings.Join(parts, ",")
+}
+
+const nomenclatureCatalog = "/odata/standard.odata/Catalog_%D0%9D%D0%BE%D0%BC%D0%B5%D0%BD%D0%BA%D0%BB%D0%B0%D1%82%D1%83%D1%80%D0%B0"
+
+const nomenclatureURL = nomenclatureCatalog + "/?$format=json"
+
+// odataQuote quotes a string literal for an OData $filter.
+func odataQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// odataEscape encodes a query option value the way 1C expects it.
+func odataEscape(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+// _skippedFolders counts the folder items met by fetchProducts.
+var _skippedFolders int
+
+// _deletionMarked counts the items marked for deletion in 1C met by
+// fetchProducts; _deletionMarkedProducts lists the products among them.
+var _deletionMarked int
+
+var _deletionMarkedProducts []string
+
+// fetchProducts loads the Номенклатура items matching the OData filter and
+// returns the products, collecting `_`-suffixed articles into _variants.
+// Folders and items marked for deletion are left out.
+func fetchProducts(filter string) []nomenclatureItem {
+	products := make([]nomenclatureItem, 0)
+	productsAndVariantsRaw := odinCRequest("GET", nomenclatureURL+"&$filter="+odataEscape(filter)+"&$orderby=%D0%94%D0%B0%D1%82%D0%B0%D0%9F%D0%B5%D1%80%D0%B5%D0%B8%D0%B7%D0%B4%D0%B0%D0%BD%D0%B8%D1%8F%20asc", nil)
+	for _, productRaw := range odataValues(productsAndVariantsRaw) {
+		sourceProduct := decodeNomenclatureItem(productRaw)
+		slug := sourceProduct.article
+		subparts := strings.Split(slug, "_")
+		if sourceProduct.isFolder {
+			_skippedFolders++
+			continue
+		}
+		if sourceProduct.deletionMark {
+			// a marked variant is left out, so it gets pruned from its product
+			_deletionMarked++
+			if len(subparts) != 2 {
+				_deletionMarkedProducts = append(_deletionMarkedProducts, slug)
+			}
+			logVerbose("Marked for deletion in 1C: " + slug)
+			continue
+		}
+		if len(subparts) == 2 {
+			productSlug := subparts[0]
+			_variants[productSlug] = append(_variants[productSlug], sourceProduct)
+		} else {
+			products = append(products, sourceProduct)
+		}
+	}
+	return products
+}
+
+// countSkippedItems reports the folders and deletion-marked items left out
+// by fetchProducts.
+func countSkippedItems(report *runReport) {
+	trackProgress(func() {
+		report.Folders = _skippedFolders
+		report.DeletionMarked = _deletionMarked
+	})
+}
+
+// trackProgress applies a change to a report that may be read concurrently
+// by the control API.
+func trackProgress(change func()) {
+	_statusMutex.Lock()
+	defer _statusMutex.Unlock()
+	change()
+}
+
+// importProducts imports products until ctx is cancelled and returns the
+// SKUs it went through. skip tells which products are already up to date.
+func importProducts(ctx context.Context, products []nomenclatureItem, report *runReport, skip func(slug string, signature string) bool) []string {
+	_newProducts := make([]string, 0)
+	trackProgress(func() { report.Products = len(products) })
+	for _, sourceProduct := range products {
+		if ctx.Err() != nil {
+			trackProgress(func() { report.Interrupted = true })
+			break
+		}
+		slug := sourceProduct.article
+		signature := productSignature(sourceProduct)
+		trackProgress(func() { report.Current = slug })
+		if skip(slug, signature) {
+			trackProgress(func() { report.Unchanged++ })
+		} else if importProduct(sourceProduct) {
+			trackProgress(func() { report.Imported++ })
+			_syncedVersions[slug] = signature
+		} else {
+			trackProgress(func() { report.Failed++ })
+		}
+		trackProgress(func() {
+			report.Processed++
+			report.Current = ""
+		})
+		_newProducts = append(_newProducts, slug)
+	}
+	return _newProducts
+}
+
+// newRunReport creates the report of a starting run and publishes it as
+// the running one.
+func newRunReport(mode string) *runReport {
+	report := &runReport{
+		Mode:    mode,
+		Started: time.Now(),
+	}
+	trackProgress(func() { _status.Running = report })
+	return report
+}
+
+func finishRunReport(report *runReport) {
+	saveState()
+	trackProgress(func() {
+		report.Finished = time.Now()
+		report.Throughput = []string{_syliusLimiter.summary(), _odinCLimiter.summary()}
+	})
+}
+
+// runSync imports every 1C product into Sylius. Full runs also refresh
+// categories and reference catalogs and then disable and prune whatever
+// is gone from 1C; incremental runs only import products whose 1C data
+// changed since the previous run of this process.
+func runSync(ctx context.Context, options syncOptions) *runReport {
+	report := newRunReport(options.mode)
+	defer finishRunReport(report)
+
+	resetRunState()
+	ensureSyliusToken()
+	if options.mode == syncModeFull {
+		refreshReferences()
+	}
+	syncPrices()
+
+	processed := make(map[string]bool)
+	if options.resume {
+		processed = loadCheckpoint()
+		if _outputFormat == outputText {
+			fmt.Println("Resuming, already processed:", len(processed))
+		}
+	}
+
+	_existingProducts := make([]existingProduct, 0)
+	if options.mode == syncModeFull {
+		_existingProducts = fetchExistingProducts()
+	}
+
+	logVerbose("Get products from 1C")
+	products := fetchProducts("Артикул ne ''")
+	countSkippedItems(report)
+	_newProducts := importProducts(ctx, products, report, func(slug string, signature string) bool {
+		return processed[slug] || (options.mode == syncModeIncremental && signature != "" && _syncedVersions[slug] == signature)
+	})
+	if report.Interrupted {
+		if !_dryRun {
+			saveCheckpoint(_newProducts)
+			color.Yellow("Interrupted, checkpoint saved to " + checkpointPath() + ", run with --resume to continue")
+		}
+		return report
+	}
+	pruneStaleVariants(report)
+
+	if options.mode != syncModeFull {
+		return report
+	}
+
+	guardedPrune(_existingProducts, _newProducts, report)
+	if !_dryRun {
+		removeCheckpoint()
+	}
+	return report
+}
+
+// existingProduct is a product listed by fetchExistingProducts.
+type existingProduct struct {
+	code    string
+	enabled bool
+}
+
+// fetchExistingProducts lists all products in Sylius.
+func fetchExistingProducts() []existingProduct {
+	_existingProducts := make([]existingProduct, 0)
+	existingProducts := syliusRequest("GET", "/api/v1/products/?limit=1000", nil, "application/json")
+	for _, productRaw := range existingProducts["_embedded"].(map[string]interface{})["items"].([]interface{}) {
+		product := productRaw.(map[string]interface{})
+		// without the flag in the listing the product is taken as enabled
+		enabled, ok := product["enabled"].(bool)
+		_existingProducts = append(_existingProducts, existingProduct{code: product["code"].(string), enabled: enabled || !ok})
+	}
+	return _existingProducts
+}
+
+// disableMissingProducts disables the Sylius products that are no longer in 1C.
+func disableMissingProducts(missing []string, report *runReport) {
+	for _, slug := range missing {
+		body, _ := json.Marshal(map[string]interface{}{
+			"enabled": false,
+		})
+		syliusRequest("PATCH", "/api/v1/products/"+slug, bytes.NewReader(body), "application/json")
+		logVerbose("Disabled " + slug)
+		trackProgress(func() { report.Disabled++ })
+	}
+}
+
+// deleteMissingProducts deletes the Sylius products that have been missing
+// from 1C for longer than DELETE_AFTER. Sylius refuses to delete products
+// that orders refer to; those stay tracked and count as failed.
+func deleteMissingProducts(missing []string, report *runReport) {
+	for _, slug := range missing {
+		syliusRequest("DELETE", "/api/v1/products/"+slug, nil, "application/json")
+		// the response of a refused DELETE is not reliable, the product is
+		// looked up again instead
+		if !_dryRun {
+			if remaining := syliusRequest("GET", "/api/v1/products/"+slug, nil, "application/json"); remaining["code"] != 404.00 {
+				color.Red("Cannot delete " + slug + ", disabling it instead")
+				body, _ := json.Marshal(map[string]interface{}{
+					"enabled": false,
+				})
+				syliusRequest("PATCH", "/api/v1/products/"+slug, bytes.NewReader(body), "application/json")
+				trackProgress(func() { report.Failed++ })
+				continue
+			}
+		}
+		delete(_state.Missing, slug)
+		for variantSlug := range _state.Prices {
+			if variantSlug == slug || strings.HasPrefix(variantSlug, slug+"_") {
+				delete(_state.Prices, variantSlug)
+			}
+		}
+		logVerbose("Deleted " + slug)
+		trackProgress(func() { report.Deleted++ })
+	}
+}
+
+// enabledProducts returns the products among slugs that exist in Sylius
+// and are enabled.
+func enabledProducts(slugs []string) []string {
+	enabled := make([]string, 0)
+	for _, slug := range slugs {
+		product := syliusRequest("GET", "/api/v1/products/"+slug, nil, "application/json")
+		if isEnabled, ok := product["enabled"].(bool); product["code"] == slug && (isEnabled || !ok) {
+			enabled = append(enabled, slug)
+		}
+	}
+	return enabled
+}
+
+// removeDeletionMarkedProducts disables the products marked for deletion in
+// 1C and removes all their variants.
+func removeDeletionMarkedProducts(slugs []string, report *runReport) {
+	for _, slug := range slugs {
+		body, _ := json.Marshal(map[string]interface{}{
+			"enabled": false,
+		})
+		syliusRequest("PATCH", "/api/v1/products/"+slug, bytes.NewReader(body), "application/json")
+		existing := syliusRequest("GET", "/api/v1/products/"+slug+"/variants/?limit=100", nil, "application/json")
+		if embedded, ok := existing["_embedded"].(map[string]interface{}); ok {
+			for _, item := range embedded["items"].([]interface{}) {
+				code := item.(map[string]interface{})["code"].(string)
+				syliusRequest("DELETE", "/api/v1/products/"+slug+"/variants/"+code, nil, "application/json")
+				delete(_state.Prices, code)
+			}
+		}
+		logVerbose("Removed product marked for deletion " + slug)
+		trackProgress(func() { report.Disabled++ })
+	}
+}
+
+// runPrune disables products missing from 1C and prunes unused authors and
+// publishers without importing anything.
+func runPrune() *runReport {
+	report := newRunReport(syncModePrune)
+	defer finishRunReport(report)
+
+	resetRunState()
+	ensureSyliusToken()
+	fetchCategories()
+	fetchValues()
+	fetchManufacturers()
+	existing := fetchExistingProducts()
+	products := fetchProducts("Артикул ne ''")
+	countSkippedItems(report)
+	present := make([]string, 0)
+	for _, sourceProduct := range products {
+		markTaxonsInUse(sourceProduct)
+		present = append(present, sourceProduct.article)
+	}
+	report.Products = len(products)
+	guardedPrune(existing, present, report)
+	return report
+}
+
+// runPriceSync PATCHes the channel pricings of the variants whose price or
+// originalPrice changed since they were last sent to Sylius. Variants with
+// no saved price, as with a new state file, get their price sent anyway;
+// variants missing in Sylius, or without a price, are left to the full sync.
+func runPriceSync(ctx context.Context) *runReport {
+	report := newRunReport(syncModePrices)
+	defer finishRunReport(report)
+
+	resetRunState()
+	ensureSyliusToken()
+	syncPrices()
+	if len(_state.Prices) == 0 {
+		color.Yellow("No synced prices in " + statePath() + ", sending every price")
+	}
+	products := fetchProducts("Артикул ne ''")
+	countSkippedItems(report)
+	trackProgress(func() { report.Products = len(products) })
+	for _, sourceProduct := range products {
+		if ctx.Err() != nil {
+			trackProgress(func() { report.Interrupted = true })
+			break
+		}
+		slug := sourceProduct.article
+		trackProgress(func() { report.Current = slug })
+		for _, variant := range append([]nomenclatureItem{sourceProduct}, _variants[slug]...) {
+			variantSlug := variant.article
+			priceItem, hasPrice := _prices[variant.refKey]
+			if !hasPrice || priceItem.price <= 0 {
+				continue
+			}
+			current := variantPrice{Price: priceItem.price, OriginalPrice: originalPriceOf(variant)}
+			if saved, exists := _state.Prices[variantSlug]; exists && current == saved {
+				trackProgress(func() { report.Unchanged++ })
+				continue
+			}
+			// null clears the crossed-out price of a discount that ended
+			pricing := map[string]interface{}{"price": current.Price, "originalPrice": nil}
+			if current.OriginalPrice > 0 {
+				pricing["originalPrice"] = current.OriginalPrice
+			}
+			body, _ := json.Marshal(map[string]interface{}{
+				"channelPricings": map[string]interface{}{"default": pricing},
+			})
+			result := syliusRequest("PATCH", "/api/v1/products/"+slug+"/variants/"+variantSlug, bytes.NewReader(body), "application/json")
+			if result["code"] == 404.00 {
+				logVerbose("Not in Sylius yet, left to the full sync: " + variantSlug)
+				continue
+			}
+			if val, ok := result["errors"]; ok {
+				color.Red("ERROR prices!")
+				fmt.Println(val)
+				trackProgress(func() { report.Failed++ })
+				continue
+			}
+			logVerbose("Updated price of " + variantSlug)
+			_state.Prices[variantSlug] = current
+			trackProgress(func() { report.Imported++ })
+		}
+		trackProgress(func() {
+			report.Processed++
+			report.Current = ""
+		})
+	}
+	return report
+}
+
+// syncSKUs imports only the given articles and their variants, leaving
+// everything else in Sylius untouched.
+func syncSKUs(ctx context.Context, skus []string) *runReport {
+	report := newRunReport(syncModeSKU)
+	defer finishRunReport(report)
+
+	if len(skus) == 0 {
+		return report
+	}
+	resetRunState()
+	ensureSyliusToken()
+
+	conditions := make([]string, 0)
+	for _, sku := range skus {
+		conditions = append(conditions, "Артикул eq "+odataQuote(sku), "startswith(Артикул, "+odataQuote(sku+"_")+")")
+	}
+	products := fetchProducts(strings.Join(conditions, " or "))
+	countSkippedItems(report)
+	refKeys := make([]string, 0)
+	for _, product := range products {
+		refKeys = append(refKeys, product.refKey)
+		for _, variant := range _variants[product.article] {
+			refKeys = append(refKeys, variant.refKey)
+		}
+	}
+	syncPricesOf(refKeys)
+	for _, sku := range skus {
+		found := false
+		for _, product := range products {
+			if product.article == sku {
+				found = true
+			}
+		}
+		if !found {
+			color.Yellow("Article not found in 1C: " + sku)
+		}
+	}
+	importProducts(ctx, products, report, func(slug string, signature string) bool {
+		return false
+	})
+	if !report.Interrupted {
+		pruneStaleVariants(report)
+		removeDeletionMarkedProducts(enabledProducts(_deletionMarkedProducts), report)
+	}
+	return report
+}
+
+func printRunReport(report *runReport) {
+	if _outputFormat == outputJSON {
+		body, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(body))
+		return
+	}
+	fmt.Printf("%s sync: %d products, %d imported, %d unchanged, %d failed, %d disabled, %d deleted in %s\n",
+		report.Mode, report.Products, report.Imported, report.Unchanged, report.Failed, report.Disabled, report.Deleted,
+		report.Finished.Sub(report.Started).Round(time.Second))
+	if report.PrunedVariants > 0 {
+		fmt.Println("Pruned variants:", report.PrunedVariants)
+	}
+	if report.Folders > 0 || report.DeletionMarked > 0 {
+		fmt.Printf("Skipped %d folders and %d items marked for deletion\n", report.Folders, report.DeletionMarked)
+	}
+	if report.PrunedCategories > 0 {
+		fmt.Println("Pruned categories:", report.PrunedCategories)
+	}
+	for _, line := range report.Throughput {
+		fmt.Println(line)
+	}
+	if report.SafetyAbort != "" {
+		color.Red(report.SafetyAbort)
+	}
+	if report.Error != "" {
+		color.Red("Sync failed: " + report.Error)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// staleVariant is a Sylius variant without a matching 1C article.
+type staleVariant struct {
+	product string
+	code    string
+}
+
+var _staleVariants []staleVariant
+
+// _seenVariants counts the Sylius variants inspected during the run.
+var _seenVariants int
+
+// variantPruneDisables tells whether VARIANT_PRUNE_MODE=disable is set.
+func variantPruneDisables() bool {
+	return strings.ToLower(envOrDefault("VARIANT_PRUNE_MODE", "delete")) == "disable"
+}
+
+// collectStaleVariants lists the Sylius variants of a product and remembers
+// those whose article is no longer among the 1C variants of the product.
+// In the disable mode the variants disabled by an earlier run are skipped.
+func collectStaleVariants(slug string, variants []nomenclatureItem) {
+	articles := make([]string, 0)
+	for _, variant := range variants {
+		articles = append(articles, variant.article)
+	}
+	existing := syliusRequest("GET", "/api/v1/products/"+slug+"/variants/?limit=100", nil, "application/json")
+	embedded, ok := existing["_embedded"].(map[string]interface{})
+	if !ok {
+		// the product is new
+		return
+	}
+	disable := variantPruneDisables()
+	for _, itemRaw := range embedded["items"].([]interface{}) {
+		item := itemRaw.(map[string]interface{})
+		code := item["code"].(string)
+		_seenVariants++
+		if containsString(articles, code) {
+			continue
+		}
+		if tracked, _ := item["tracked"].(bool); disable && tracked && item["onHand"] == 0.0 {
+			logVerbose("Stale variant disabled already: " + code)
+			continue
+		}
+		_staleVariants = append(_staleVariants, staleVariant{product: slug, code: code})
+	}
+}
+
+// pruneStaleVariants deletes the collected stale variants, or with
+// VARIANT_PRUNE_MODE=disable makes them unavailable the way the hidden
+// flag does, unless there are more of them than the safety thresholds allow.
+// The thresholds are measured against the variants of the whole catalogue,
+// as the state knows them, so a run touching a few products is not held to
+// those alone.
+func pruneStaleVariants(report *runReport) {
+	total := _seenVariants
+	if len(_state.Prices) > total {
+		total = len(_state.Prices)
+	}
+	if err := checkRemovalThreshold("variants", len(_staleVariants), total); err != nil {
+		reason := "variant prune skipped: " + err.Error() + ", use --force to override"
+		trackProgress(func() {
+			if report.SafetyAbort != "" {
+				report.SafetyAbort += "; "
+			}
+			report.SafetyAbort += reason
+		})
+		return
+	}
+	disable := variantPruneDisables()
+	for _, variant := range _staleVariants {
+		url := "/api/v1/products/" + variant.product + "/variants/" + variant.code
+		if disable {
+			body, _ := json.Marshal(map[string]interface{}{
+				"tracked": true,
+				"onHand":  0,
+			})
+			syliusRequest("PATCH", url, bytes.NewReader(body), "application/json")
+			logVerbose("Disabled variant " + variant.code)
+		} else {
+			syliusRequest("DELETE", url, nil, "application/json")
+			logVerbose("Deleted variant " + variant.code)
+		}
+		delete(_state.Prices, variant.code)
+		trackProgress(func() { report.PrunedVariants++ })
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var guidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// webhookDebouncer collects the Ref_Keys sent by 1C and syncs them once no
+// new ones arrived for the debounce delay, so rapid edits coalesce.
+type webhookDebouncer struct {
+	mutex   sync.Mutex
+	delay   time.Duration
+	pending map[string]bool
+	timer   *time.Timer
+	flush   func(refKeys []string)
+}
+
+func (debouncer *webhookDebouncer) add(refKey string) {
+	debouncer.mutex.Lock()
+	defer debouncer.mutex.Unlock()
+	debouncer.pending[refKey] = true
+	if debouncer.timer != nil {
+		debouncer.timer.Stop()
+	}
+	debouncer.timer = time.AfterFunc(debouncer.delay, func() {
+		debouncer.mutex.Lock()
+		refKeys := make([]string, 0, len(debouncer.pending))
+		for key := range debouncer.pending {
+			refKeys = append(refKeys, key)
+		}
+		debouncer.pending = make(map[string]bool)
+		debouncer.mutex.Unlock()
+		if len(refKeys) > 0 {
+			debouncer.flush(refKeys)
+		}
+	})
+}
+
+// validWebhookSignature checks the X-Signature header, the hex HMAC-SHA256
+// of the body keyed with WEBHOOK_SECRET, optionally prefixed with "sha256=".
+func validWebhookSignature(body []byte, signature string) bool {
+	secret, _ := os.LookupEnv("WEBHOOK_SECRET")
+	if secret == "" {
+		return false
+	}
+	provided, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(provided, mac.Sum(nil))
+}
+
+// articlesForRefKeys resolves changed Номенклатура items to the articles of
+// their products, so a changed variant re-imports its whole product.
+func articlesForRefKeys(refKeys []string) []string {
+	articles := make([]string, 0)
+	for _, refKey := range refKeys {
+		item := decodeNomenclatureItem(odinCRequest("GET", nomenclatureCatalog+"(guid'"+refKey+"')?$format=json", nil))
+		article := item.article
+		if article == "" {
+			logVerbose("Webhook item without article: " + refKey)
+			continue
+		}
+		article = strings.Split(article, "_")[0]
+		if !containsString(articles, article) {
+			articles = append(articles, article)
+		}
+	}
+	return articles
+}
+
+// webhookMaxBody is far more than a {"Ref_Key": ...} notification needs.
+const webhookMaxBody = 16 << 10
+
+func handleWebhook(debouncer *webhookDebouncer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+			return
+		}
+		// the body is read before the signature is checked, so it is capped
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBody))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if !validWebhookSignature(body, r.Header.Get("X-Signature")) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid signature"})
+			return
+		}
+		var payload struct {
+			RefKey string `json:"Ref_Key"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil || !guidPattern.MatchString(payload.RefKey) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Ref_Key must be a GUID"})
+			return
+		}
+		debouncer.add(payload.RefKey)
+		writeJSON(w, http.StatusAccepted, map[string]string{"Ref_Key": payload.RefKey})
+	}
+}
+
+// newWebhookDebouncer syncs debounced Ref_Keys as a SKU run, waiting for
+// any other run to finish first.
+func newWebhookDebouncer(ctx context.Context) *webhookDebouncer {
+	delay, err := time.ParseDuration(envOrDefault("WEBHOOK_DEBOUNCE", "10s"))
+	if err != nil {
+		panic("Invalid WEBHOOK_DEBOUNCE: " + err.Error())
+	}
+	return &webhookDebouncer{
+		delay:   delay,
+		pending: make(map[string]bool),
+		flush: func(refKeys []string) {
+			_runMutex.Lock()
+			defer _runMutex.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+			executeRun(syncModeSKU, func() *runReport {
+				return syncSKUs(ctx, articlesForRefKeys(refKeys))
+			})
+		},
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+func TestValidWebhookSignature(t *testing.T) {
+	body := []byte(`{"Ref_Key":"39c57eb5-5016-11e7-89aa-3085a93bff67"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name      string
+		secret    string
+		body      []byte
+		signature string
+		want      bool
+	}{
+		{"valid", "secret", body, signature, true},
+		{"valid with prefix", "secret", body, "sha256=" + signature, true},
+		{"other secret", "other", body, signature, false},
+		{"changed body", "secret", []byte(`{}`), signature, false},
+		{"not hex", "secret", body, "sha256=zz", false},
+		{"empty signature", "secret", body, "", false},
+		{"no secret configured", "", body, signature, false},
+	}
+	defer os.Unsetenv("WEBHOOK_SECRET")
+	for _, test := range tests {
+		os.Setenv("WEBHOOK_SECRET", test.secret)
+		if got := validWebhookSignature(test.body, test.signature); got != test.want {
+			t.Errorf("%s: validWebhookSignature = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ymlCatalog struct {
+	XMLName xml.Name `xml:"yml_catalog"`
+	Date    string   `xml:"date,attr"`
+	Shop    ymlShop  `xml:"shop"`
+}
+
+type ymlShop struct {
+	Name       string        `xml:"name"`
+	Company    string        `xml:"company"`
+	URL        string        `xml:"url"`
+	Currencies []ymlCurrency `xml:"currencies>currency"`
+	Categories []ymlCategory `xml:"categories>category"`
+	Offers     []ymlOffer    `xml:"offers>offer"`
+}
+
+type ymlCurrency struct {
+	ID   string `xml:"id,attr"`
+	Rate string `xml:"rate,attr"`
+}
+
+type ymlCategory struct {
+	ID       int    `xml:"id,attr"`
+	ParentID int    `xml:"parentId,attr,omitempty"`
+	Name     string `xml:",chardata"`
+}
+
+type ymlOffer struct {
+	ID          string     `xml:"id,attr"`
+	Available   bool       `xml:"available,attr"`
+	Name        string     `xml:"name"`
+	Vendor      string     `xml:"vendor,omitempty"`
+	URL         string     `xml:"url"`
+	Price       string     `xml:"price"`
+	OldPrice    string     `xml:"oldprice,omitempty"`
+	CurrencyID  string     `xml:"currencyId"`
+	CategoryID  int        `xml:"categoryId"`
+	Delivery    bool       `xml:"delivery"`
+	Description string     `xml:"description,omitempty"`
+	Barcode     string     `xml:"barcode,omitempty"`
+	Params      []ymlParam `xml:"param"`
+}
+
+type ymlParam struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+func formatPrice(price float64) string {
+	return strconv.FormatFloat(price, 'f', 2, 64)
+}
+
+// exportYML writes a Yandex.Market YML catalog: the mirrored categories and
+// one offer per priced variant with the book properties as params.
+func exportYML(writer io.Writer) {
+	products, categories := collectCatalog()
+
+	shopName, _ := os.LookupEnv("YML_SHOP_NAME")
+	company, _ := os.LookupEnv("YML_COMPANY")
+	shopURL, _ := os.LookupEnv("SHOP_URL")
+	shop := ymlShop{
+		Name:       shopName,
+		Company:    company,
+		URL:        shopURL,
+		Currencies: []ymlCurrency{{ID: "RUR", Rate: "1"}},
+		// offers without a mirrored category go to the default one
+		Categories: []ymlCategory{{ID: 1, Name: envOrDefault("YML_DEFAULT_CATEGORY", "Книги")}},
+	}
+	// YML wants numeric category ids
+	categoryIDs := make(map[string]int)
+	for _, category := range categories {
+		categoryIDs[category.code] = len(categoryIDs) + 2
+	}
+	for _, category := range categories {
+		shop.Categories = append(shop.Categories, ymlCategory{
+			ID:       categoryIDs[category.code],
+			ParentID: categoryIDs[category.parent],
+			Name:     category.name,
+		})
+	}
+
+	for _, product := range products {
+		params := make([]ymlParam, 0)
+		addParam := func(name string, value string) {
+			if value != "" {
+				params = append(params, ymlParam{Name: name, Value: value})
+			}
+		}
+		addParam("Автор", strings.Join(product.authors, ", "))
+		addParam("Составитель", strings.Join(product.compilers, ", "))
+		addParam("Редактор", strings.Join(product.editors, ", "))
+		addParam("Переводчик", strings.Join(product.translators, ", "))
+		addParam("Издательство", product.publisher)
+		addParam("ISBN", product.isbn)
+		addParam("Количество страниц", product.pages)
+		addParam("Переплет", product.coverType)
+		addParam("Размеры", product.size)
+		addParam("Вес", product.dimensions["weight"])
+		if !product.publishDate.IsZero() {
+			addParam("Год издания", strconv.Itoa(product.publishDate.Year()))
+		}
+
+		categoryID := 1
+		if id, ok := categoryIDs[product.category]; ok {
+			categoryID = id
+		}
+		name := product.name
+		if product.subtitle != "" {
+			name += ". " + product.subtitle
+		}
+		for _, variant := range product.variants {
+			if variant.price <= 0 {
+				continue
+			}
+			offer := ymlOffer{
+				ID:          variant.article,
+				Available:   !variant.hidden,
+				Name:        name,
+				Vendor:      product.publisher,
+				URL:         productURL(product.article),
+				Price:       formatPrice(variant.price),
+				CurrencyID:  "RUR",
+				CategoryID:  categoryID,
+				Delivery:    variantTypes[variant.variantType].(map[string]interface{})["shippingRequired"].(bool),
+				Description: product.description,
+				Params:      append([]ymlParam{{Name: "Формат", Value: variantTypes[variant.variantType].(map[string]interface{})["title"].(string)}}, params...),
+			}
+			if variant.originalPrice > variant.price {
+				offer.OldPrice = formatPrice(variant.originalPrice)
+			}
+			if variant.variantType == "default" {
+				offer.Barcode = strings.ReplaceAll(product.isbn, "-", "")
+			}
+			shop.Offers = append(shop.Offers, offer)
+		}
+	}
+
+	io.WriteString(writer, xml.Header)
+	encoder := xml.NewEncoder(writer)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(ymlCatalog{Date: time.Now().Format("2006-01-02T15:04-07:00"), Shop: shop}); err != nil {
+		panic(err)
+	}
+	io.WriteString(writer, "\n")
+}